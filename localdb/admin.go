@@ -0,0 +1,345 @@
+package localdb
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"m.cluseau.fr/go/httperr"
+)
+
+const (
+	adminDefaultLimit = 100
+	adminMaxLimit     = 1000
+)
+
+type AdminOptions struct {
+	// Write enables the set and delete requests.
+	Write bool
+	// Authorize is called before each write request, which is denied if it returns an error.
+	// An httperr.Error is returned as is, other errors as 403 Forbidden.
+	Authorize func(req *http.Request) error
+}
+
+// AdminHandler returns a handler to inspect buckets:
+//
+//	GET    /                        lists the buckets
+//	GET    /{bucket}/keys           lists keys and values (query: prefix, after, limit, values=0 to omit values)
+//	GET    /{bucket}/value?key=...  gets a value
+//	PUT    /{bucket}/value?key=...  sets a value from the JSON body (write mode only)
+//	DELETE /{bucket}/value?key=...  deletes a value (write mode only)
+//
+// Keys and prefixes are given as strings, or base64 (URL encoding) with key64, prefix64 and after64.
+// In-memory buckets are accessed with mem=1.
+func AdminHandler(opts AdminOptions) http.Handler {
+	return adminHandler{opts}
+}
+
+type adminHandler struct {
+	opts AdminOptions
+}
+
+type AdminBucket struct {
+	Name     string      `json:"name"`
+	InMemory bool        `json:"inMemory,omitempty"`
+	Open     *BucketInfo `json:"open,omitempty"`
+}
+
+type AdminEntry struct {
+	Key   string          `json:"key"`
+	Key64 string          `json:"key64,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+type AdminKeys struct {
+	Entries []AdminEntry `json:"entries"`
+	// Next is the after64 parameter to get the next page, if any
+	Next string `json:"next,omitempty"`
+}
+
+func (h adminHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	v, err := h.serve(req)
+	if err != nil {
+		httpErr, ok := err.(httperr.Error)
+		if !ok {
+			if errors.As(err, &ConflictError{}) {
+				httpErr = httperr.New(http.StatusConflict, err)
+			} else {
+				httpErr = httperr.Internal(err)
+			}
+		}
+		httpErr.WriteJSON(w)
+		return
+	}
+
+	if v == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (h adminHandler) serve(req *http.Request) (v any, err error) {
+	path := strings.Trim(req.URL.Path, "/")
+
+	if path == "" {
+		if req.Method != http.MethodGet {
+			return nil, methodNotAllowed()
+		}
+		return listBuckets()
+	}
+
+	bucketName, op, _ := strings.Cut(path, "/")
+	if bucketName == "." || bucketName == ".." {
+		return nil, badRequest(errors.New("invalid bucket name"))
+	}
+
+	inMemory := req.FormValue("mem") == "1"
+
+	// check the request before opening the bucket, so only authorized writes open it writable
+	var key []byte
+	write := false
+
+	switch op {
+	case "keys":
+		if req.Method != http.MethodGet {
+			return nil, methodNotAllowed()
+		}
+
+	case "value":
+		switch req.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodDelete:
+			if err = h.authorizeWrite(req); err != nil {
+				return
+			}
+			write = true
+		default:
+			return nil, methodNotAllowed()
+		}
+
+		if key, err = keyParam(req, "key"); err != nil {
+			return
+		}
+		if key == nil {
+			return nil, badRequest(errors.New("key is required"))
+		}
+
+	default:
+		return nil, httperr.NotFound
+	}
+
+	db, err := openAdminBucket(bucketName, inMemory, write)
+	if err != nil {
+		return
+	}
+
+	defer db.Close()
+
+	if op == "keys" {
+		return listKeys(db, req)
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		value, err := db.Get(key)
+		if err == ErrNotFound {
+			return nil, httperr.NotFound
+		}
+		return value, err
+
+	case http.MethodDelete:
+		return nil, db.Delete(key)
+
+	default:
+		data, err := io.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		if !json.Valid(data) {
+			return nil, badRequest(errors.New("body is not valid JSON"))
+		}
+		return nil, db.SetRaw(key, data)
+	}
+}
+
+func (h adminHandler) authorizeWrite(req *http.Request) (err error) {
+	if !h.opts.Write {
+		return httperr.New(http.StatusForbidden, errors.New("read-only"))
+	}
+
+	if h.opts.Authorize == nil {
+		return
+	}
+
+	if err = h.opts.Authorize(req); err != nil {
+		if _, ok := err.(httperr.Error); !ok {
+			err = httperr.New(http.StatusForbidden, err)
+		}
+	}
+	return
+}
+
+func listBuckets() (buckets []AdminBucket, err error) {
+	open := map[bucketKey]BucketInfo{}
+	for _, info := range OpenBuckets() {
+		open[bucketKey{info.Name, info.InMemory}] = info
+	}
+
+	entries, err := os.ReadDir(dbPath)
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+	err = nil
+
+	buckets = make([]AdminBucket, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		bucket := AdminBucket{Name: entry.Name()}
+		if info, ok := open[bucketKey{name: entry.Name()}]; ok {
+			bucket.Open = &info
+		}
+		buckets = append(buckets, bucket)
+	}
+
+	for key, info := range open {
+		if !key.inMemory {
+			continue
+		}
+		info := info
+		buckets = append(buckets, AdminBucket{Name: key.name, InMemory: true, Open: &info})
+	}
+
+	sort.Slice(buckets, func(i, j int) bool {
+		if buckets[i].Name == buckets[j].Name {
+			return !buckets[i].InMemory
+		}
+		return buckets[i].Name < buckets[j].Name
+	})
+	return
+}
+
+// openAdminBucket opens an existing bucket (never creating one). Unless write is set, a bucket not already open is
+// opened read-only so inspecting it doesn't change it.
+func openAdminBucket(name string, inMemory, write bool) (db DB[json.RawMessage], err error) {
+	var exists bool
+	if inMemory {
+		bucketsLock.Lock()
+		_, exists = buckets[bucketKey{name, true}]
+		bucketsLock.Unlock()
+	} else {
+		exists, err = Exists(name)
+		if err != nil {
+			return
+		}
+	}
+
+	if !exists {
+		err = httperr.NotFound
+		return
+	}
+
+	opts := []Option{}
+	if inMemory {
+		opts = append(opts, InMemory())
+	}
+	if !write {
+		opts = append(opts, readOnly())
+	}
+
+	return Open[json.RawMessage](name, opts...)
+}
+
+func listKeys(db DB[json.RawMessage], req *http.Request) (res AdminKeys, err error) {
+	prefix, err := keyParam(req, "prefix")
+	if err != nil {
+		return
+	}
+	after, err := keyParam(req, "after")
+	if err != nil {
+		return
+	}
+
+	limit := adminDefaultLimit
+	if s := req.FormValue("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit <= 0 || limit > adminMaxLimit {
+			err = badRequest(errors.New("invalid limit"))
+			return
+		}
+	}
+
+	withValues := req.FormValue("values") != "0"
+
+	lower := prefix
+	if after != nil && string(after) >= string(prefix) {
+		lower = append(after, 0)
+	}
+
+	res.Entries = make([]AdminEntry, 0)
+	err = db.scan(lower, prefixEnd(prefix), func(key []byte, v json.RawMessage) error {
+		if len(res.Entries) == limit {
+			res.Next = base64.URLEncoding.EncodeToString(res.Entries[limit-1].rawKey())
+			return errStopScan
+		}
+
+		entry := AdminEntry{Key: string(key)}
+		if !utf8.Valid(key) {
+			entry.Key64 = base64.URLEncoding.EncodeToString(key)
+		}
+		if withValues {
+			entry.Value = v
+		}
+
+		res.Entries = append(res.Entries, entry)
+		return nil
+	})
+	if err == errStopScan {
+		err = nil
+	}
+	return
+}
+
+func (e AdminEntry) rawKey() []byte {
+	if e.Key64 != "" {
+		key, _ := base64.URLEncoding.DecodeString(e.Key64)
+		return key
+	}
+	return []byte(e.Key)
+}
+
+// keyParam returns the key given by name, or name+"64" in base64. Returns nil if none is given.
+func keyParam(req *http.Request, name string) (key []byte, err error) {
+	if s := req.FormValue(name + "64"); s != "" {
+		key, err = base64.URLEncoding.DecodeString(s)
+		if err != nil {
+			err = badRequest(errors.New("invalid " + name + "64: " + err.Error()))
+		}
+		return
+	}
+
+	if s := req.FormValue(name); s != "" {
+		key = []byte(s)
+	}
+	return
+}
+
+func badRequest(err error) error {
+	return httperr.New(http.StatusBadRequest, err)
+}
+
+func methodNotAllowed() error {
+	return httperr.New(http.StatusMethodNotAllowed, errors.New(http.StatusText(http.StatusMethodNotAllowed)))
+}
@@ -0,0 +1,170 @@
+package localdb
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+)
+
+func adminRequest(t *testing.T, h http.Handler, method, url, body string) (*httptest.ResponseRecorder, string) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, url, strings.NewReader(body)))
+	return w, strings.TrimSpace(w.Body.String())
+}
+
+func TestAdminInMemory(t *testing.T) {
+	db := openTest[string](t)
+	for _, k := range []string{"a", "b", "c"} {
+		if err := db.Set([]byte(k), strings.ToUpper(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := AdminHandler(AdminOptions{})
+	base := "/" + t.Name()
+
+	w, body := adminRequest(t, h, "GET", "/", "")
+	if w.Code != 200 || !strings.Contains(body, `{"name":"`+t.Name()+`","inMemory":true`) {
+		t.Errorf("buckets: %d %s", w.Code, body)
+	}
+
+	if w, body := adminRequest(t, h, "GET", base+"/keys?mem=1&limit=2", ""); w.Code != 200 ||
+		body != `{"entries":[{"key":"a","value":"A"},{"key":"b","value":"B"}],"next":"Yg=="}` {
+		t.Errorf("keys: %d %s", w.Code, body)
+	}
+	if w, body := adminRequest(t, h, "GET", base+"/keys?mem=1&values=0&after64=Yg==", ""); w.Code != 200 ||
+		body != `{"entries":[{"key":"c"}]}` {
+		t.Errorf("keys after b: %d %s", w.Code, body)
+	}
+
+	if w, body := adminRequest(t, h, "GET", base+"/value?mem=1&key=b", ""); w.Code != 200 || body != `"B"` {
+		t.Errorf("value: %d %s", w.Code, body)
+	}
+	if w, _ := adminRequest(t, h, "GET", base+"/value?mem=1&key=x", ""); w.Code != 404 {
+		t.Errorf("missing value: %d", w.Code)
+	}
+	if w, _ := adminRequest(t, h, "GET", base+"/value?key=b", ""); w.Code != 404 {
+		t.Errorf("bucket not on disk: %d", w.Code)
+	}
+	if w, _ := adminRequest(t, h, "GET", "/missing/keys?mem=1", ""); w.Code != 404 {
+		t.Errorf("missing bucket: %d", w.Code)
+	}
+
+	if w, _ := adminRequest(t, h, "PUT", base+"/value?mem=1&key=d", `"D"`); w.Code != 403 {
+		t.Errorf("write in read-only mode: %d", w.Code)
+	}
+	if _, err := db.Get([]byte("d")); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestAdminWrite(t *testing.T) {
+	db := openTest[string](t)
+
+	h := AdminHandler(AdminOptions{
+		Write: true,
+		Authorize: func(req *http.Request) error {
+			if req.Header.Get("X-Test") != "ok" {
+				return errors.New("denied")
+			}
+			return nil
+		},
+	})
+	url := "/" + t.Name() + "/value?mem=1&key=a"
+
+	if w, _ := adminRequest(t, h, "PUT", url, `"A"`); w.Code != 403 {
+		t.Errorf("unauthorized write: %d", w.Code)
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("PUT", url, strings.NewReader(`"A"`))
+	req.Header.Set("X-Test", "ok")
+	if h.ServeHTTP(w, req); w.Code != 204 {
+		t.Fatalf("write: %d %s", w.Code, w.Body)
+	}
+	if v, err := db.Get([]byte("a")); err != nil || v != "A" {
+		t.Errorf("got %q, %v", v, err)
+	}
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("PUT", url, strings.NewReader(`{`))
+	req.Header.Set("X-Test", "ok")
+	if h.ServeHTTP(w, req); w.Code != 400 {
+		t.Errorf("invalid JSON: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("DELETE", url, nil)
+	req.Header.Set("X-Test", "ok")
+	if h.ServeHTTP(w, req); w.Code != 204 {
+		t.Fatalf("delete: %d %s", w.Code, w.Body)
+	}
+	if _, err := db.Get([]byte("a")); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestAdminReadOnly(t *testing.T) {
+	tempDBPath(t)
+
+	// a bucket without metadata, as written by an older version
+	path := filepath.Join(dbPath, t.Name())
+	raw, err := pebble.Open(path, pebbleOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = raw.Set([]byte("a"), []byte(`"A"`), pebble.Sync); err != nil {
+		t.Fatal(err)
+	}
+	raw.Close()
+
+	h := AdminHandler(AdminOptions{})
+
+	if w, body := adminRequest(t, h, "GET", "/"+t.Name()+"/keys", ""); w.Code != 200 ||
+		body != `{"entries":[{"key":"a","value":"A"}]}` {
+		t.Errorf("keys: %d %s", w.Code, body)
+	}
+	if w, body := adminRequest(t, h, "GET", "/"+t.Name()+"/value?key=a", ""); w.Code != 200 || body != `"A"` {
+		t.Errorf("value: %d %s", w.Code, body)
+	}
+
+	// rejected writes don't open it writable either
+	if w, _ := adminRequest(t, h, "PUT", "/"+t.Name()+"/value?key=b", `"B"`); w.Code != 403 {
+		t.Errorf("write in read-only mode: %d", w.Code)
+	}
+	if w, _ := adminRequest(t, h, "POST", "/"+t.Name()+"/value?key=b", `"B"`); w.Code != 405 {
+		t.Errorf("POST: %d", w.Code)
+	}
+	denied := AdminHandler(AdminOptions{
+		Write:     true,
+		Authorize: func(req *http.Request) error { return errors.New("denied") },
+	})
+	if w, _ := adminRequest(t, denied, "DELETE", "/"+t.Name()+"/value?key=a", ""); w.Code != 403 {
+		t.Errorf("unauthorized delete: %d", w.Code)
+	}
+
+	if len(OpenBuckets()) != 0 {
+		t.Errorf("read-only buckets should not stay open: %v", OpenBuckets())
+	}
+
+	opts := pebbleOptions()
+	opts.ReadOnly = true
+	raw, err = pebble.Open(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+
+	var meta json.RawMessage
+	if found, err := getJSON(raw, metaKey, &meta); err != nil || found {
+		t.Errorf("meta written: %s, %v", meta, err)
+	}
+}
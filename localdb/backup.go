@@ -0,0 +1,287 @@
+package localdb
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// Checkpoint writes a consistent copy of the DB to dir, which must not exist. Copying this directory to a bucket
+// path of a (stopped) DB restores it.
+func (db DB[T]) Checkpoint(dir string) error {
+	if db.b.inMemory {
+		return errors.New("in-memory buckets can't be checkpointed, use Export")
+	}
+	return db.b.raw.Checkpoint(dir)
+}
+
+// Export format:
+//
+//	magic, format version (1 byte), header length (uvarint), header (JSON)
+//	for each record: recordTag, key length (uvarint), key, value length (uvarint), value
+//	endTag, record count (uvarint), SHA-256 of all the previous bytes
+const (
+	exportMagic   = "LOCALDB\n"
+	exportVersion = 1
+
+	recordTag = 'r'
+	endTag    = 'e'
+
+	importBatchSize = 4 << 20
+	maxRecordSize   = 256 << 20
+)
+
+var ErrInvalidExport = errors.New("invalid export")
+
+type ExportHeader struct {
+	Bucket        string `json:"bucket"`
+	Codec         string `json:"codec"`
+	SchemaVersion int    `json:"schemaVersion"`
+}
+
+// Export writes a portable copy of every record of the DB, including localdb's own (metadata, indexes...).
+func (db DB[T]) Export(out io.Writer) (err error) {
+	snapshot := db.b.raw.NewSnapshot()
+	defer snapshot.Close()
+
+	meta, _, err := readMeta(snapshot, db.b.schema.Load().schema)
+	if err != nil {
+		return
+	}
+
+	header, err := json.Marshal(ExportHeader{
+		Bucket:        db.b.name,
+		Codec:         meta.Codec,
+		SchemaVersion: meta.SchemaVersion,
+	})
+	if err != nil {
+		return
+	}
+
+	buf := bufio.NewWriter(out)
+	h := sha256.New()
+	w := io.MultiWriter(buf, h)
+
+	writeBytes := func(ba []byte) (err error) {
+		if _, err = w.Write(binary.AppendUvarint(nil, uint64(len(ba)))); err != nil {
+			return
+		}
+		_, err = w.Write(ba)
+		return
+	}
+
+	if _, err = w.Write(append([]byte(exportMagic), exportVersion)); err != nil {
+		return
+	}
+	if err = writeBytes(header); err != nil {
+		return
+	}
+
+	count := uint64(0)
+	err = iterate(snapshot, nil, nil, func(key, value []byte) (err error) {
+		if _, err = w.Write([]byte{recordTag}); err != nil {
+			return
+		}
+		if err = writeBytes(key); err != nil {
+			return
+		}
+		if err = writeBytes(value); err != nil {
+			return
+		}
+		count++
+		return
+	})
+	if err != nil {
+		return
+	}
+
+	if _, err = w.Write(binary.AppendUvarint([]byte{endTag}, count)); err != nil {
+		return
+	}
+	if _, err = buf.Write(h.Sum(nil)); err != nil {
+		return
+	}
+
+	return buf.Flush()
+}
+
+// Import creates the bucket from an export. The bucket must not exist; it's removed if the import fails.
+func Import(bucket string, in io.Reader) (header ExportHeader, err error) {
+	exists, err := Exists(bucket)
+	if err != nil {
+		return
+	}
+	if exists {
+		err = fmt.Errorf("bucket already exists: %q", bucket)
+		return
+	}
+
+	path := filepath.Join(dbPath, bucket)
+
+	raw, err := pebble.Open(path, pebbleOptions())
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if closeErr := raw.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.RemoveAll(path)
+		}
+	}()
+
+	header, err = importTo(raw, in)
+	return
+}
+
+func importTo(raw *pebble.DB, in io.Reader) (header ExportHeader, err error) {
+	r := &hashReader{r: bufio.NewReader(in), h: sha256.New()}
+
+	invalid := func(format string, args ...any) error {
+		return fmt.Errorf("%w: %s", ErrInvalidExport, fmt.Sprintf(format, args...))
+	}
+
+	magic := make([]byte, len(exportMagic)+1)
+	if _, err = io.ReadFull(r, magic); err != nil {
+		return
+	}
+	if string(magic[:len(exportMagic)]) != exportMagic {
+		err = invalid("bad magic")
+		return
+	}
+	if magic[len(exportMagic)] != exportVersion {
+		err = invalid("unsupported format version %d", magic[len(exportMagic)])
+		return
+	}
+
+	headerBytes, err := r.readBytes()
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(headerBytes, &header); err != nil {
+		err = invalid("bad header: %v", err)
+		return
+	}
+	if header.Codec != codecJSON {
+		err = invalid("unsupported codec: %q", header.Codec)
+		return
+	}
+
+	batch := raw.NewBatch()
+	defer func() { batch.Close() }()
+
+	count := uint64(0)
+	batchSize := 0
+
+	for {
+		var tag byte
+		tag, err = r.ReadByte()
+		if err == io.EOF {
+			err = invalid("truncated")
+			return
+		} else if err != nil {
+			return
+		}
+
+		if tag == endTag {
+			break
+		}
+		if tag != recordTag {
+			err = invalid("bad record tag: %q", tag)
+			return
+		}
+
+		var key, value []byte
+		if key, err = r.readBytes(); err != nil {
+			return
+		}
+		if value, err = r.readBytes(); err != nil {
+			return
+		}
+
+		if err = batch.Set(key, value, nil); err != nil {
+			return
+		}
+		count++
+
+		batchSize += len(key) + len(value)
+		if batchSize >= importBatchSize {
+			if err = batch.Commit(nil); err != nil {
+				return
+			}
+			batch.Close()
+			batch = raw.NewBatch()
+			batchSize = 0
+		}
+	}
+
+	expectedCount, err := binary.ReadUvarint(r)
+	if err != nil {
+		return
+	}
+	if expectedCount != count {
+		err = invalid("%d records read but %d expected", count, expectedCount)
+		return
+	}
+
+	sum := r.h.Sum(nil)
+	expectedSum := make([]byte, len(sum))
+	if _, err = io.ReadFull(r.r, expectedSum); err != nil {
+		return
+	}
+	if !bytes.Equal(sum, expectedSum) {
+		err = invalid("checksum mismatch")
+		return
+	}
+
+	err = batch.Commit(pebble.Sync)
+	return
+}
+
+// hashReader hashes what is read through it.
+type hashReader struct {
+	r *bufio.Reader
+	h hash.Hash
+}
+
+func (r *hashReader) Read(ba []byte) (n int, err error) {
+	n, err = r.r.Read(ba)
+	r.h.Write(ba[:n])
+	return
+}
+
+func (r *hashReader) ReadByte() (b byte, err error) {
+	b, err = r.r.ReadByte()
+	if err == nil {
+		r.h.Write([]byte{b})
+	}
+	return
+}
+
+func (r *hashReader) readBytes() (ba []byte, err error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return
+	}
+
+	if n > maxRecordSize {
+		err = fmt.Errorf("%w: record too large (%d bytes)", ErrInvalidExport, n)
+		return
+	}
+
+	ba = make([]byte, n)
+	_, err = io.ReadFull(r, ba)
+	return
+}
@@ -0,0 +1,131 @@
+package localdb
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func exportTest(t *testing.T) []byte {
+	t.Helper()
+
+	db := openTest[testUser](t)
+	if err := db.AddUniqueIndex("email", userEmail); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, email := range map[string]string{"u1": "a@x", "u2": "b@x", "\x00bin": "c@x"} {
+		if err := db.Set([]byte(key), testUser{Email: email}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	if err := db.Export(buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExportImport(t *testing.T) {
+	tempDBPath(t)
+
+	export := exportTest(t)
+
+	name := t.Name() + "-restored"
+
+	header, err := Import(name, bytes.NewReader(export))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Bucket != t.Name() || header.Codec != codecJSON {
+		t.Errorf("unexpected header: %+v", header)
+	}
+
+	db, err := Open[testUser](name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if u, err := db.Get([]byte("\x00bin")); err != nil || u.Email != "c@x" {
+		t.Errorf("restored value: %+v, %v", u, err)
+	}
+
+	// indexes are part of the export
+	if err = db.AddUniqueIndex("email", userEmail); err != nil {
+		t.Fatal(err)
+	}
+	if key, _, err := db.GetBy("email", []byte("b@x")); err != nil || string(key) != "u2" {
+		t.Errorf("restored index: %q, %v", key, err)
+	}
+
+	if _, err = Import(name, bytes.NewReader(export)); err == nil {
+		t.Error("import into an existing bucket should fail")
+	}
+}
+
+func TestImportInvalid(t *testing.T) {
+	tempDBPath(t)
+
+	export := exportTest(t)
+
+	corrupted := bytes.Clone(export)
+	idx := bytes.Index(corrupted, []byte("b@x"))
+	corrupted[idx] = 'B'
+
+	for name, data := range map[string][]byte{
+		"checksum":  corrupted,
+		"truncated": export[:len(export)-10],
+		// the export ends with the end tag, the record count (1 byte here) and the checksum
+		"no end": export[:len(export)-2-sha256.Size],
+		"magic":  append([]byte("NOTLOCAL"), export[len(exportMagic):]...),
+	} {
+		bucket := t.Name() + "-" + name
+
+		if _, err := Import(bucket, bytes.NewReader(data)); err == nil {
+			t.Errorf("%s: import should fail", name)
+		} else if name != "truncated" && !errors.Is(err, ErrInvalidExport) {
+			t.Errorf("%s: expected ErrInvalidExport, got %v", name, err)
+		}
+
+		if exists, err := Exists(bucket); err != nil || exists {
+			t.Errorf("%s: failed import should be removed (exists=%v, err=%v)", name, exists, err)
+		}
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	tempDBPath(t)
+
+	if err := openTest[string](t).Checkpoint(t.TempDir()); err == nil {
+		t.Error("in-memory buckets should not be checkpointed")
+	}
+
+	db, err := Open[string](t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err = db.Set([]byte("a"), "A"); err != nil {
+		t.Fatal(err)
+	}
+
+	name := t.Name() + "-restored"
+	if err = db.Checkpoint(filepath.Join(dbPath, name)); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := Open[string](name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+
+	if v, err := restored.Get([]byte("a")); err != nil || v != "A" {
+		t.Errorf("restored value: %q, %v", v, err)
+	}
+}
@@ -0,0 +1,467 @@
+package localdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+)
+
+var (
+	bucketsLock sync.Mutex
+	buckets     = map[bucketKey]*bucket{}
+)
+
+type bucketKey struct {
+	name     string
+	inMemory bool
+}
+
+// bucket is the state of an open bucket, shared by all the DBs opened on it.
+type bucket struct {
+	bucketKey
+	raw  *pebble.DB
+	refs int
+	// closed is set by CloseAll, so the DBs still referencing the bucket don't release it again
+	closed bool
+	// readOnly buckets are not shared (see the readOnly option)
+	readOnly bool
+
+	// l serializes writes so index checks and updates are consistent
+	l     sync.Mutex
+	views map[reflect.Type]view
+	// viewList keeps views in creation order so writes are prepared in a stable order
+	viewList []view
+
+	schema atomic.Pointer[schemaState]
+
+	now             func() time.Time
+	hasTTL          atomic.Bool
+	janitorInterval time.Duration
+	janitorOnce     sync.Once
+	stopJanitorCh   chan struct{}
+	janitorDone     chan struct{}
+}
+
+// view is the state of a bucket specific to a value type (implemented by dbState).
+type view interface {
+	needsValues() bool
+	// prevExpired is set when prevData has expired, so it's replaced but not visible anymore
+	prepare(batch *pebble.Batch, m *mutation, prevData []byte, prevExpired bool) (committed func(), err error)
+	rebuildStaleIndexes() error
+	close()
+}
+
+func openBucket(name string, o options) (b *bucket, err error) {
+	bucketsLock.Lock()
+	defer bucketsLock.Unlock()
+
+	key := bucketKey{name, o.inMemory}
+	b = buckets[key]
+
+	if b != nil {
+		if err = b.checkSchema(o.schema); err != nil {
+			return
+		}
+
+		b.refs++
+		return
+	}
+
+	readOnly := o.readOnly && !o.inMemory
+
+	var raw *pebble.DB
+	if o.inMemory {
+		pebbleOpts := pebbleOptions()
+		pebbleOpts.FS = vfs.NewMem()
+		raw, err = pebble.Open(name, pebbleOpts)
+	} else {
+		pebbleOpts := pebbleOptions()
+		pebbleOpts.ReadOnly = readOnly
+		raw, err = openPebble(filepath.Join(dbPath, name), pebbleOpts)
+	}
+	if err != nil {
+		return
+	}
+
+	b = &bucket{
+		bucketKey:       key,
+		raw:             raw,
+		refs:            1,
+		readOnly:        readOnly,
+		views:           map[reflect.Type]view{},
+		now:             o.now,
+		janitorInterval: o.janitorInterval,
+		stopJanitorCh:   make(chan struct{}),
+	}
+
+	if err = b.initSchema(o.schema); err != nil {
+		raw.Close()
+		return
+	}
+
+	if readOnly {
+		return
+	}
+
+	if b.hasTTL.Load() {
+		b.startJanitor()
+	}
+
+	buckets[key] = b
+	return
+}
+
+func (b *bucket) checkSchema(schema *Schema) (err error) {
+	if schema == nil {
+		return
+	}
+
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	current := b.schema.Load().schema
+	if current == nil {
+		if err = b.initSchema(schema); err != nil {
+			return
+		}
+
+		// the schema version changed under the declared indexes
+		for _, v := range b.viewList {
+			if err = v.rebuildStaleIndexes(); err != nil {
+				return
+			}
+		}
+		return
+	}
+
+	if current.Version != schema.Version {
+		return fmt.Errorf("bucket %q already open with schema version %d", b.name, current.Version)
+	}
+	return
+}
+
+func (b *bucket) release() (err error) {
+	bucketsLock.Lock()
+	defer bucketsLock.Unlock()
+
+	if b.closed {
+		return
+	}
+
+	if b.readOnly {
+		b.closed = true
+		return b.close()
+	}
+
+	if buckets[b.bucketKey] != b {
+		return
+	}
+
+	b.refs--
+	if b.refs > 0 {
+		return
+	}
+
+	b.closed = true
+
+	delete(buckets, b.bucketKey)
+	return b.close()
+}
+
+func (b *bucket) close() error {
+	b.stopJanitor()
+
+	b.l.Lock()
+	for _, v := range b.viewList {
+		v.close()
+	}
+	b.l.Unlock()
+
+	return b.raw.Close()
+}
+
+// CloseAll closes every open bucket, whatever the DBs still referencing them. It's meant for graceful shutdowns.
+func CloseAll() (err error) {
+	bucketsLock.Lock()
+	defer bucketsLock.Unlock()
+
+	errs := make([]error, 0)
+	for key, b := range buckets {
+		if closeErr := b.close(); closeErr != nil {
+			errs = append(errs, fmt.Errorf("bucket %q: %w", key.name, closeErr))
+		}
+		b.refs = 0
+		b.closed = true
+		delete(buckets, key)
+	}
+
+	return errors.Join(errs...)
+}
+
+type BucketInfo struct {
+	Name     string `json:"name"`
+	InMemory bool   `json:"inMemory,omitempty"`
+	Refs     int    `json:"refs"`
+
+	Compactions  int64  `json:"compactions"`
+	MemTableSize uint64 `json:"memTableSize"`
+	DiskUsage    uint64 `json:"diskUsage"`
+}
+
+// OpenBuckets lists the open buckets, sorted by name.
+func OpenBuckets() (infos []BucketInfo) {
+	bucketsLock.Lock()
+	defer bucketsLock.Unlock()
+
+	infos = make([]BucketInfo, 0, len(buckets))
+	for _, b := range buckets {
+		metrics := b.raw.Metrics()
+
+		infos = append(infos, BucketInfo{
+			Name:         b.name,
+			InMemory:     b.inMemory,
+			Refs:         b.refs,
+			Compactions:  metrics.Compact.Count,
+			MemTableSize: metrics.MemTable.Size,
+			DiskUsage:    metrics.DiskSpaceUsage(),
+		})
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Name == infos[j].Name {
+			return !infos[i].InMemory
+		}
+		return infos[i].Name < infos[j].Name
+	})
+	return
+}
+
+// openBucketReader returns a reader on the (on disk) bucket, using the open one if any.
+func openBucketReader(name string) (r pebble.Reader, close func() error, err error) {
+	bucketsLock.Lock()
+	b := buckets[bucketKey{name: name}]
+	if b != nil {
+		b.refs++
+	}
+	bucketsLock.Unlock()
+
+	if b != nil {
+		snapshot := b.raw.NewSnapshot()
+		return snapshot, func() error {
+			snapshot.Close()
+			return b.release()
+		}, nil
+	}
+
+	pebbleOpts := pebbleOptions()
+	pebbleOpts.ReadOnly = true
+
+	raw, err := openPebble(filepath.Join(dbPath, name), pebbleOpts)
+	if err != nil {
+		return
+	}
+	return raw, raw.Close, nil
+}
+
+func pebbleOptions() *pebble.Options {
+	return &pebble.Options{Merger: merger}
+}
+
+// openPebble opens an on-disk bucket, falling back to legacyMerger for buckets created with pebble's default merger.
+func openPebble(path string, opts *pebble.Options) (raw *pebble.DB, err error) {
+	raw, err = pebble.Open(path, opts)
+	if err != nil && strings.Contains(err.Error(), fmt.Sprintf("merger name from file %q", legacyMerger.Name)) {
+		opts.Merger = legacyMerger
+		raw, err = pebble.Open(path, opts)
+	}
+	return
+}
+
+func getView[T any](b *bucket) (s *dbState[T]) {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	t := reflect.TypeOf((*T)(nil)).Elem()
+
+	if v, ok := b.views[t]; ok {
+		return v.(*dbState[T])
+	}
+
+	s = &dbState[T]{b: b}
+	b.views[t] = s
+	b.viewList = append(b.viewList, s)
+	return
+}
+
+// mutation is a change of a key's value
+type mutation struct {
+	key []byte
+	// data is nil for a delete
+	data []byte
+	// v is the decoded data (a *T), if already known
+	v any
+	// expires is the zero time when the value doesn't expire
+	expires time.Time
+	// migrated is set when the value is rewritten by a schema migration: its expiry is kept, the indexes are not
+	// updated (they are rebuilt after the migration) and no change is published
+	migrated bool
+}
+
+func (b *bucket) getRaw(key []byte, processData func(data []byte) error) (err error) {
+	expired, err := b.expired(b.raw, key)
+	if err != nil {
+		return
+	} else if expired {
+		return ErrNotFound
+	}
+
+	if b.schema.Load().pending() {
+		// read the value and its version marker from the same snapshot
+		snap := b.raw.NewSnapshot()
+		defer snap.Close()
+
+		data, err := b.getStored(snap, key)
+		if err != nil {
+			return err
+		} else if data == nil {
+			return ErrNotFound
+		}
+		return processData(data)
+	}
+
+	data, closer, err := b.raw.Get(key)
+	if err != nil {
+		return
+	}
+
+	defer closer.Close()
+	err = processData(data)
+	return
+}
+
+// getStored returns a copy of the value of key migrated to the current schema, or nil if not found.
+// It does not write, so it's safe to call with the write lock held.
+func (b *bucket) getStored(r pebble.Reader, key []byte) (data []byte, err error) {
+	data, err = readStored(r, key)
+	if err != nil || data == nil {
+		return
+	}
+
+	return b.upgradeStored(r, key, data)
+}
+
+// readStored returns a copy of the value of key as stored, or nil if not found.
+func readStored(r pebble.Reader, key []byte) (data []byte, err error) {
+	stored, closer, err := r.Get(key)
+	if err == ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return
+	}
+
+	defer closer.Close()
+	return bytes.Clone(stored), nil
+}
+
+// write applies the mutations in one batch with the index updates.
+func (b *bucket) write(mutations ...*mutation) (err error) {
+	for _, m := range mutations {
+		if isSysKey(m.key) {
+			return ErrInvalidKey
+		}
+	}
+
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	return b.writeLocked(mutations...)
+}
+
+func (b *bucket) writeLocked(mutations ...*mutation) (err error) {
+	// indexed so mutations see the previous ones of the batch
+	batch := b.raw.NewIndexedBatch()
+	defer batch.Close()
+
+	committed := make([]func(), 0)
+
+	for _, m := range mutations {
+		var c []func()
+		if c, err = b.prepare(batch, m); err != nil {
+			return
+		}
+		committed = append(committed, c...)
+	}
+
+	if err = batch.Commit(nil); err != nil {
+		return
+	}
+
+	for _, c := range committed {
+		c()
+	}
+	return
+}
+
+func (b *bucket) prepare(batch *pebble.Batch, m *mutation) (committed []func(), err error) {
+	key, data := m.key, m.data
+
+	if !m.migrated && b.needsValues() {
+		var prev []byte
+		if prev, err = b.getStored(batch, key); err != nil {
+			return
+		}
+
+		var prevExpired bool
+		if prev != nil {
+			if prevExpired, err = b.expired(batch, key); err != nil {
+				return
+			}
+		}
+
+		for _, v := range b.viewList {
+			var c func()
+			if c, err = v.prepare(batch, m, prev, prevExpired); err != nil {
+				return
+			}
+			if c != nil {
+				committed = append(committed, c)
+			}
+		}
+	}
+
+	if err = b.writeVersion(batch, key, data == nil); err != nil {
+		return
+	}
+	if !m.migrated {
+		if err = b.writeExpiry(batch, key, m.expires); err != nil {
+			return
+		}
+	}
+
+	if data == nil {
+		err = batch.Delete(key, nil)
+	} else {
+		err = batch.Set(key, data, nil)
+	}
+	return
+}
+
+// needsValues tells if writes must read previous values. Must be called with the write lock held.
+func (b *bucket) needsValues() bool {
+	for _, v := range b.viewList {
+		if v.needsValues() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package localdb
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCloseAll(t *testing.T) {
+	db, err := Open[string](t.Name(), InMemory())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = CloseAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	db2, err := Open[string](t.Name(), InMemory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close()
+
+	if err = db2.Set([]byte("a"), "A"); err != nil {
+		t.Fatal(err)
+	}
+
+	// releasing a DB of the closed bucket must not close the new one
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := db2.Get([]byte("a")); err != nil || v != "A" {
+		t.Errorf("got %q, %v", v, err)
+	}
+
+	infos := OpenBuckets()
+	if len(infos) != 1 || infos[0].Name != t.Name() || infos[0].Refs != 1 {
+		t.Errorf("unexpected open buckets: %+v", infos)
+	}
+}
+
+func TestSharedOpen(t *testing.T) {
+	db := openTest[string](t)
+
+	db2, err := Open[string](t.Name(), InMemory())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Set([]byte("a"), "A"); err != nil {
+		t.Fatal(err)
+	}
+	if err = db2.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// still open through db
+	if v, err := db.Get([]byte("a")); err != nil || v != "A" {
+		t.Errorf("got %q, %v", v, err)
+	}
+}
+
+func TestReservedKeys(t *testing.T) {
+	db := openTest[string](t)
+
+	if err := db.Set([]byte("a"), "A"); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, write := range map[string]func(key []byte) error{
+		"Set":        func(key []byte) error { return db.Set(key, "X") },
+		"SetRaw":     func(key []byte) error { return db.SetRaw(key, []byte(`"X"`)) },
+		"Delete":     func(key []byte) error { return db.Delete(key) },
+		"SetWithTTL": func(key []byte) error { return db.SetWithTTL(key, "X", time.Hour) },
+		"Increment":  func(key []byte) error { return db.Increment(key, 1) },
+	} {
+		for _, key := range [][]byte{metaKey, sysKey("idx", "x", "a"), sysPrefix} {
+			if err := write(key); err != ErrInvalidKey {
+				t.Errorf("%s %q: expected ErrInvalidKey, got %v", name, key, err)
+			}
+		}
+	}
+
+	if meta, err := db.Meta(); err != nil || meta.TTL {
+		t.Errorf("meta changed: %+v, %v", meta, err)
+	}
+
+	// keys merely starting with zeros are fine
+	if err := db.Set([]byte("\x00\x00local"), "B"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,129 @@
+package localdb
+
+import (
+	"bytes"
+
+	"m.cluseau.fr/go/memlog"
+	"m.cluseau.fr/go/watchable"
+)
+
+// Change is a committed write to a DB. Old is nil when the key was created, New is nil when it was deleted.
+type Change[T any] struct {
+	Key []byte
+	Old *T
+	New *T
+	Seq uint64
+}
+
+// Changes returns the change feed of the DB. The feed is only enabled by the first call,
+// so DBs without listeners don't have to read previous values on writes.
+func (db DB[T]) Changes() *memlog.Memlog[Change[T]] {
+	db.b.l.Lock()
+	defer db.b.l.Unlock()
+
+	return db.s.enableChanges()
+}
+
+func (s *dbState[T]) enableChanges() *memlog.Memlog[Change[T]] {
+	if s.changes == nil {
+		s.changes = memlog.New[Change[T]]()
+	}
+	return s.changes
+}
+
+// close ends the change feed, if enabled. Must be called with the write lock held.
+func (s *dbState[T]) close() {
+	if s.changes != nil {
+		s.changes.Close()
+	}
+}
+
+// publishChange appends a change to the feed, if enabled. Must be called with the write lock held.
+func (s *dbState[T]) publishChange(key []byte, prev, v *T) {
+	if s.changes == nil {
+		return
+	}
+
+	s.changeSeq++
+	s.changes.Append(Change[T]{
+		Key: bytes.Clone(key),
+		Old: prev,
+		New: v,
+		Seq: s.changeSeq,
+	})
+}
+
+// SubscribeChanges returns the changes committed from now on to keys starting with prefix.
+func (db DB[T]) SubscribeChanges(prefix []byte, stop <-chan struct{}) <-chan Change[T] {
+	return filterChanges(db.Changes().Subscribe(stop), prefix, stop)
+}
+
+func filterChanges[T any](changes <-chan Change[T], prefix []byte, stop <-chan struct{}) <-chan Change[T] {
+	if len(prefix) == 0 {
+		return changes
+	}
+
+	out := make(chan Change[T])
+
+	go func() {
+		defer close(out)
+
+		for change := range changes {
+			if !bytes.HasPrefix(change.Key, prefix) {
+				continue
+			}
+
+			select {
+			case out <- change:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+// Bind returns a Watchable holding the value of key, kept in sync with the DB until stop is closed.
+// A missing or deleted key is seen as T's zero value. The Watchable is closed when stop is closed.
+func (db DB[T]) Bind(key []byte, stop <-chan struct{}) (w *watchable.Watchable[T], err error) {
+	key = bytes.Clone(key)
+
+	// hold the write lock so no change can happen between the initial read and the subscription
+	db.b.l.Lock()
+
+	v, err := db.getPtr(key)
+	if err != nil {
+		db.b.l.Unlock()
+		return
+	}
+
+	changes := filterChanges(db.s.enableChanges().Subscribe(stop), key, stop)
+
+	db.b.l.Unlock()
+
+	w = watchable.New[T]()
+	if v != nil {
+		w.Set(*v)
+	} else {
+		w.Set(*new(T))
+	}
+
+	go func() {
+		defer w.Close()
+
+		for change := range changes {
+			if !bytes.Equal(change.Key, key) {
+				continue
+			}
+
+			if change.New == nil {
+				w.Set(*new(T))
+			} else {
+				w.Set(*change.New)
+			}
+		}
+	}()
+
+	return
+}
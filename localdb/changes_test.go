@@ -0,0 +1,148 @@
+package localdb
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func fmtChange(c Change[string]) string {
+	v := func(p *string) string {
+		if p == nil {
+			return "-"
+		}
+		return *p
+	}
+	return fmt.Sprintf("%d %s: %s -> %s", c.Seq, c.Key, v(c.Old), v(c.New))
+}
+
+func expectChanges(t *testing.T, changes <-chan Change[string], expected ...string) {
+	t.Helper()
+
+	for _, exp := range expected {
+		select {
+		case c := <-changes:
+			if s := fmtChange(c); s != exp {
+				t.Errorf("expected change %q, got %q", exp, s)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for %q", exp)
+		}
+	}
+}
+
+func TestChanges(t *testing.T) {
+	db := openTest[string](t)
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	changes := db.SubscribeChanges([]byte("a/"), stop)
+
+	for _, op := range []func() error{
+		func() error { return db.Set([]byte("a/1"), "x") },
+		func() error { return db.Set([]byte("b/1"), "ignored") },
+		func() error { return db.Set([]byte("a/1"), "y") },
+		func() error { return db.Delete([]byte("a/1")) },
+	} {
+		if err := op(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expectChanges(t, changes, "1 a/1: - -> x", "3 a/1: x -> y", "4 a/1: y -> -")
+}
+
+func TestChangesInBatch(t *testing.T) {
+	db := openTest[string](t)
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	changes := db.SubscribeChanges(nil, stop)
+
+	// mutations of the same key in one batch see each other
+	err := db.b.write(
+		&mutation{key: []byte("k"), data: []byte(`"1"`)},
+		&mutation{key: []byte("k"), data: []byte(`"2"`)},
+		&mutation{key: []byte("k")},
+		&mutation{key: []byte("k"), data: []byte(`"3"`)},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectChanges(t, changes, "1 k: - -> 1", "2 k: 1 -> 2", "3 k: 2 -> -", "4 k: - -> 3")
+}
+
+func TestUniqueIndexInBatch(t *testing.T) {
+	db := openTest[testUser](t)
+	if err := db.AddUniqueIndex("email", userEmail); err != nil {
+		t.Fatal(err)
+	}
+
+	// a key changing its email twice frees the first one
+	err := db.b.write(
+		&mutation{key: []byte("u1"), data: []byte(`{"Email":"a@x"}`)},
+		&mutation{key: []byte("u1"), data: []byte(`{"Email":"b@x"}`)},
+		&mutation{key: []byte("u2"), data: []byte(`{"Email":"a@x"}`)},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if key, _, err := db.GetBy("email", []byte("a@x")); err != nil || string(key) != "u2" {
+		t.Errorf("a@x: got %q, %v", key, err)
+	}
+
+	// two keys taking the same email in one batch conflict
+	err = db.b.write(
+		&mutation{key: []byte("u3"), data: []byte(`{"Email":"c@x"}`)},
+		&mutation{key: []byte("u4"), data: []byte(`{"Email":"c@x"}`)},
+	)
+	if !errors.As(err, &ConflictError{}) {
+		t.Errorf("expected a conflict, got %v", err)
+	}
+}
+
+func TestBind(t *testing.T) {
+	db := openTest[string](t)
+
+	if err := db.Set([]byte("k"), "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	w, err := db.Bind([]byte("k"), stop)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	watch := w.NewWatch()
+	defer watch.Stop()
+
+	expect := func(exp string) {
+		t.Helper()
+		for {
+			v, ok, timedOut := watch.NextWithTimeout(time.Second)
+			if !ok || timedOut {
+				t.Fatalf("expected %q, got nothing", exp)
+			}
+			if v == exp {
+				return
+			}
+		}
+	}
+
+	expect("a")
+
+	db.Set([]byte("k2"), "other")
+	db.Set([]byte("k"), "b")
+	expect("b")
+
+	db.Delete([]byte("k"))
+	expect("")
+}
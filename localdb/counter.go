@@ -0,0 +1,210 @@
+package localdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// counterTag prefixes counter values and merge operands
+const counterTag = "\x00ctr"
+
+var (
+	counterKeyPrefix  = sysKey("ctr", "")
+	sequenceKeyPrefix = sysKey("seq", "")
+)
+
+// merger sums counters. Other operands are concatenated, like pebble's default merger. It has its own name, so
+// pebble refuses to open a bucket with another merger, which would break the counters.
+var merger = &pebble.Merger{
+	Name:  "localdb.counter",
+	Merge: mergeValues,
+}
+
+// legacyMerger is the same merger with the name of pebble's default merger, which buckets created before counters
+// are recorded with: pebble only opens them with a merger of that name, so they are opened with this one.
+var legacyMerger = &pebble.Merger{
+	Name:  pebble.DefaultMerger.Name,
+	Merge: mergeValues,
+}
+
+func mergeValues(_, value []byte) (pebble.ValueMerger, error) {
+	m := &valueMerger{counter: true}
+	return m, m.MergeNewer(value)
+}
+
+type valueMerger struct {
+	// counter is true while every operand is a counter
+	counter bool
+	sum     int64
+	buf     []byte
+}
+
+func (m *valueMerger) merge(value []byte) {
+	if !m.counter {
+		return
+	}
+
+	v, ok := decodeCounter(value)
+	if !ok {
+		m.counter = false
+		return
+	}
+	m.sum += v
+}
+
+func (m *valueMerger) MergeNewer(value []byte) error {
+	m.merge(value)
+	m.buf = append(m.buf, value...)
+	return nil
+}
+
+func (m *valueMerger) MergeOlder(value []byte) error {
+	m.merge(value)
+	m.buf = append(bytes.Clone(value), m.buf...)
+	return nil
+}
+
+func (m *valueMerger) Finish(includesBase bool) ([]byte, io.Closer, error) {
+	if m.counter {
+		return encodeCounter(m.sum), nil, nil
+	}
+	return m.buf, nil, nil
+}
+
+func encodeCounter(v int64) []byte {
+	return binary.BigEndian.AppendUint64([]byte(counterTag), uint64(v))
+}
+
+func decodeCounter(data []byte) (v int64, ok bool) {
+	if len(data) != len(counterTag)+8 || string(data[:len(counterTag)]) != counterTag {
+		return
+	}
+	return int64(binary.BigEndian.Uint64(data[len(counterTag):])), true
+}
+
+func counterKey(key []byte) []byte {
+	return concat(counterKeyPrefix, key)
+}
+
+// Increment atomically adds delta to the counter at key. Counters are separate from the values of the DB.
+// Increments are blind writes: concurrent increments never lose updates, and don't need to read the counter.
+func (db DB[T]) Increment(key []byte, delta int64) error {
+	if isSysKey(key) {
+		return ErrInvalidKey
+	}
+	return db.b.raw.Merge(counterKey(key), encodeCounter(delta), nil)
+}
+
+// Counter returns the value of the counter at key (0 if it was never incremented).
+func (db DB[T]) Counter(key []byte) (v int64, err error) {
+	return readCounter(db.b.raw, counterKey(key))
+}
+
+func readCounter(r pebble.Reader, key []byte) (v int64, err error) {
+	data, closer, err := r.Get(key)
+	if err == ErrNotFound {
+		return 0, nil
+	} else if err != nil {
+		return
+	}
+
+	defer closer.Close()
+
+	v, ok := decodeCounter(data)
+	if !ok {
+		err = fmt.Errorf("key %q: invalid counter", key)
+	}
+	return
+}
+
+// Sequence generates increasing unique IDs, starting at 1. IDs are leased from the DB in blocks, so there's only one
+// write per block; the unused IDs of a block are lost if the process stops without calling Release.
+type Sequence struct {
+	b     *bucket
+	key   []byte
+	lease uint64
+
+	l sync.Mutex
+	// next is the next ID to give, leased is the last leased ID
+	next, leased uint64
+}
+
+// Sequence returns the sequence with the given name, leasing IDs by blocks of lease IDs.
+func (db DB[T]) Sequence(name string, lease uint64) *Sequence {
+	if lease == 0 {
+		lease = 1
+	}
+
+	return &Sequence{
+		b:     db.b,
+		key:   concat(sequenceKeyPrefix, []byte(name)),
+		lease: lease,
+	}
+}
+
+func (s *Sequence) Next() (id uint64, err error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if s.next == 0 || s.next > s.leased {
+		if err = s.renewLease(); err != nil {
+			return
+		}
+	}
+
+	id = s.next
+	s.next++
+	return
+}
+
+func (s *Sequence) renewLease() (err error) {
+	s.b.l.Lock()
+	defer s.b.l.Unlock()
+
+	last, err := readCounter(s.b.raw, s.key)
+	if err != nil {
+		return
+	}
+
+	leased := uint64(last) + s.lease
+
+	if err = s.b.raw.Set(s.key, encodeCounter(int64(leased)), pebble.Sync); err != nil {
+		return
+	}
+
+	s.next = uint64(last) + 1
+	s.leased = leased
+	return
+}
+
+// Release gives back the unused IDs of the current lease, if no other lease was taken since.
+func (s *Sequence) Release() (err error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if s.next == 0 || s.next > s.leased {
+		return
+	}
+
+	s.b.l.Lock()
+	defer s.b.l.Unlock()
+
+	last, err := readCounter(s.b.raw, s.key)
+	if err != nil {
+		return
+	}
+
+	if uint64(last) == s.leased {
+		if err = s.b.raw.Set(s.key, encodeCounter(int64(s.next-1)), pebble.Sync); err != nil {
+			return
+		}
+	}
+
+	s.next, s.leased = 0, 0
+	return
+}
@@ -0,0 +1,184 @@
+package localdb
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+)
+
+func TestIncrement(t *testing.T) {
+	db := openTest[string](t)
+
+	if v, err := db.Counter([]byte("hits")); err != nil || v != 0 {
+		t.Errorf("new counter: %d, %v", v, err)
+	}
+
+	const workers, increments = 10, 100
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				if err := db.Increment([]byte("hits"), 2); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := db.Increment([]byte("hits"), -1); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := db.Counter([]byte("hits")); err != nil || v != 2*workers*increments-1 {
+		t.Errorf("got %d, %v", v, err)
+	}
+
+	// counters are separate from values
+	if _, err := db.Get([]byte("hits")); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestMergerConcat(t *testing.T) {
+	m, err := merger.Merge(nil, []byte("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.MergeNewer([]byte("c"))
+	m.MergeOlder(encodeCounter(1))
+
+	v, _, err := m.Finish(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != string(encodeCounter(1))+"bc" {
+		t.Errorf("got %q", v)
+	}
+}
+
+func TestSequence(t *testing.T) {
+	db := openTest[string](t)
+
+	// two sequences sharing the same name, as from two DBs
+	seqs := []*Sequence{db.Sequence("ids", 10), db.Sequence("ids", 3)}
+
+	const workers, ids = 8, 50
+
+	l := sync.Mutex{}
+	seen := map[uint64]bool{}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		seq := seqs[i%len(seqs)]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < ids; j++ {
+				id, err := seq.Next()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				l.Lock()
+				if id == 0 || seen[id] {
+					t.Errorf("invalid or duplicate id %d", id)
+				}
+				seen[id] = true
+				l.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(seen) != workers*ids {
+		t.Errorf("got %d ids", len(seen))
+	}
+}
+
+func TestSequenceRelease(t *testing.T) {
+	db := openTest[string](t)
+
+	seq := db.Sequence("ids", 10)
+	for want := uint64(1); want <= 3; want++ {
+		if id, err := seq.Next(); err != nil || id != want {
+			t.Fatalf("got %d, %v, expected %d", id, err, want)
+		}
+	}
+
+	if err := seq.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the unused IDs are given back
+	if id, err := db.Sequence("ids", 10).Next(); err != nil || id != 4 {
+		t.Errorf("got %d, %v, expected 4", id, err)
+	}
+
+	// not once another lease was taken
+	if id, err := seq.Next(); err != nil || id != 14 {
+		t.Errorf("got %d, %v, expected 14", id, err)
+	}
+	if err := seq.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	other := db.Sequence("ids", 1)
+	if id, err := other.Next(); err != nil || id != 15 {
+		t.Errorf("got %d, %v, expected 15", id, err)
+	}
+}
+
+func TestMergerName(t *testing.T) {
+	tempDBPath(t)
+
+	// a bucket created with pebble's default merger, before counters
+	legacy := filepath.Join(dbPath, t.Name()+"-legacy")
+	raw, err := pebble.Open(legacy, &pebble.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = raw.Set([]byte("a"), []byte(`"A"`), pebble.Sync); err != nil {
+		t.Fatal(err)
+	}
+	raw.Close()
+
+	db, err := Open[string](t.Name() + "-legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.Get([]byte("a")); err != nil || v != "A" {
+		t.Errorf("got %q, %v", v, err)
+	}
+	for i := 0; i < 3; i++ {
+		if err = db.Increment([]byte("hits"), 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v, err := db.Counter([]byte("hits")); err != nil || v != 3 {
+		t.Errorf("got %d, %v", v, err)
+	}
+	db.Close()
+
+	// new buckets can't be opened with another merger
+	db, err = Open[string](t.Name() + "-new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Increment([]byte("hits"), 1); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	if raw, err := pebble.Open(filepath.Join(dbPath, t.Name()+"-new"), &pebble.Options{}); err == nil {
+		raw.Close()
+		t.Error("opened with pebble's default merger")
+	}
+}
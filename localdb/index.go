@@ -0,0 +1,373 @@
+package localdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// indexVersionPrefix + index name holds the schema version the index was built for
+var indexVersionPrefix = sysKey("idxver", "")
+
+var (
+	ErrNoSuchIndex  = errors.New("no such index")
+	ErrIndexDefined = errors.New("index already defined differently")
+)
+
+// ConflictError is returned when a write would give an already used key to a unique index.
+type ConflictError struct {
+	Index string
+	Key   []byte
+	Owner []byte
+}
+
+var _ error = ConflictError{}
+
+func (err ConflictError) Error() string {
+	return fmt.Sprintf("index %q: key %q already used by %q", err.Index, err.Key, err.Owner)
+}
+
+type index[T any] struct {
+	name   string
+	unique bool
+	keys   func(v T) [][]byte
+	prefix []byte
+	// keysFn identifies the keys function, to recognize the same declaration
+	keysFn uintptr
+}
+
+func (idx *index[T]) entryKey(indexKey, key []byte) (entry []byte) {
+	entry = appendEscaped(bytes.Clone(idx.prefix), indexKey, true)
+	if !idx.unique {
+		entry = append(entry, key...)
+	}
+	return
+}
+
+// AddIndex declares an index maintained on each write. The keys function returns the index keys of a value.
+// Indexes should be added right after Open. The index is built from the values when it's declared for the first time,
+// or when the schema version changed since it was built; otherwise entries of values written while the index was not
+// declared must be built with RebuildIndexes.
+// As DBs of the same bucket and type share their indexes, declaring an index again with the same keys function
+// does nothing, but it fails with ErrIndexDefined if the declaration differs.
+func (db DB[T]) AddIndex(name string, keys func(v T) [][]byte) error {
+	return db.addIndex(name, false, keys)
+}
+
+// AddUniqueIndex is like AddIndex, but writes giving an index key to a second value fail with a ConflictError.
+func (db DB[T]) AddUniqueIndex(name string, keys func(v T) [][]byte) error {
+	return db.addIndex(name, true, keys)
+}
+
+func (db DB[T]) addIndex(name string, unique bool, keys func(v T) [][]byte) (err error) {
+	if strings.IndexByte(name, 0) != -1 {
+		return fmt.Errorf("invalid index name: %q", name)
+	}
+
+	db.b.l.Lock()
+	defer db.b.l.Unlock()
+
+	keysFn := reflect.ValueOf(keys).Pointer()
+
+	if idx := db.s.index(name); idx != nil {
+		if idx.unique != unique || idx.keysFn != keysFn {
+			err = fmt.Errorf("%w: %q", ErrIndexDefined, name)
+		}
+		return
+	}
+
+	idx := &index[T]{
+		name:   name,
+		unique: unique,
+		keys:   keys,
+		prefix: sysKey("idx", name, ""),
+		keysFn: keysFn,
+	}
+
+	built, err := indexVersion(db.b.raw, name)
+	if err != nil {
+		return
+	}
+	if built != db.b.schema.Load().version() {
+		if err = db.s.rebuildIndexes([]*index[T]{idx}); err != nil {
+			return
+		}
+	}
+
+	db.s.indexes = append(db.s.indexes, idx)
+	return
+}
+
+func indexVersionKey(name string) []byte {
+	return concat(indexVersionPrefix, []byte(name))
+}
+
+// indexVersion returns the schema version the index was built for, -1 if it was never built.
+func indexVersion(r pebble.Reader, name string) (version int, err error) {
+	data, closer, err := r.Get(indexVersionKey(name))
+	if err == ErrNotFound {
+		return -1, nil
+	} else if err != nil {
+		return
+	}
+
+	defer closer.Close()
+
+	if len(data) != 4 {
+		err = fmt.Errorf("index %q: invalid version", name)
+		return
+	}
+	return int(binary.BigEndian.Uint32(data)), nil
+}
+
+func setIndexVersion(w pebble.Writer, name string, version int) error {
+	return w.Set(indexVersionKey(name), binary.BigEndian.AppendUint32(nil, uint32(version)), nil)
+}
+
+// rebuildStaleIndexes rebuilds the indexes built for another schema version. Must be called with the write lock held.
+func (s *dbState[T]) rebuildStaleIndexes() (err error) {
+	version := s.b.schema.Load().version()
+
+	stale := make([]*index[T], 0)
+	for _, idx := range s.indexes {
+		built, err := indexVersion(s.b.raw, idx.name)
+		if err != nil {
+			return err
+		}
+		if built != version {
+			stale = append(stale, idx)
+		}
+	}
+
+	if len(stale) == 0 {
+		return
+	}
+	return s.rebuildIndexes(stale)
+}
+
+func (s *dbState[T]) index(name string) *index[T] {
+	for _, idx := range s.indexes {
+		if idx.name == name {
+			return idx
+		}
+	}
+	return nil
+}
+
+func (db DB[T]) getIndex(name string) (idx *index[T], err error) {
+	db.b.l.Lock()
+	defer db.b.l.Unlock()
+
+	idx = db.s.index(name)
+	if idx == nil {
+		err = fmt.Errorf("%w: %q", ErrNoSuchIndex, name)
+	}
+	return
+}
+
+// updateIndexes adds to the batch the index changes for key going from prev to v (nil for a missing value).
+// Must be called with the write lock held.
+func (s *dbState[T]) updateIndexes(batch *pebble.Batch, key []byte, prev, v *T) (err error) {
+	for _, idx := range s.indexes {
+		var prevKeys, newKeys [][]byte
+		if prev != nil {
+			prevKeys = idx.keys(*prev)
+		}
+		if v != nil {
+			newKeys = idx.keys(*v)
+		}
+
+		for _, indexKey := range prevKeys {
+			if containsKey(newKeys, indexKey) {
+				continue
+			}
+
+			entryKey := idx.entryKey(indexKey, key)
+
+			if idx.unique {
+				// only remove the entry if it's ours
+				var owner []byte
+				if owner, err = readStored(batch, entryKey); err != nil {
+					return
+				}
+				if !bytes.Equal(owner, key) {
+					continue
+				}
+			}
+
+			if err = batch.Delete(entryKey, nil); err != nil {
+				return
+			}
+		}
+
+		for _, indexKey := range newKeys {
+			entryKey := idx.entryKey(indexKey, key)
+
+			if idx.unique {
+				if err = s.checkUnique(batch, idx, indexKey, entryKey, key); err != nil {
+					return
+				}
+			}
+
+			if err = batch.Set(entryKey, key, nil); err != nil {
+				return
+			}
+		}
+	}
+
+	return
+}
+
+// checkUnique checks that the entry of a unique index is free or already owned by key, as seen from the batch.
+// An entry owned by an expired key is free.
+func (s *dbState[T]) checkUnique(batch *pebble.Batch, idx *index[T], indexKey, entryKey, key []byte) (err error) {
+	owner, err := readStored(batch, entryKey)
+	if err != nil || owner == nil || bytes.Equal(owner, key) {
+		return
+	}
+
+	expired, err := s.b.expired(batch, owner)
+	if err != nil || expired {
+		return
+	}
+
+	return ConflictError{Index: idx.name, Key: bytes.Clone(indexKey), Owner: owner}
+}
+
+func containsKey(keys [][]byte, key []byte) bool {
+	for _, k := range keys {
+		if bytes.Equal(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetBy returns the first value (in key order) having the given key in the index.
+func (db DB[T]) GetBy(index string, indexKey []byte) (key []byte, v T, err error) {
+	idx, err := db.getIndex(index)
+	if err != nil {
+		return
+	}
+
+	err = db.scanIndex(appendEscaped(bytes.Clone(idx.prefix), indexKey, true), func(k []byte, value T) error {
+		key, v = k, value
+		return errStopScan
+	})
+
+	if err == errStopScan {
+		err = nil
+	} else if err == nil {
+		err = ErrNotFound
+	}
+	return
+}
+
+// ScanBy calls fn for each value having an index key starting with prefix, in index key order.
+func (db DB[T]) ScanBy(index string, prefix []byte, fn func(key []byte, v T) error) (err error) {
+	idx, err := db.getIndex(index)
+	if err != nil {
+		return
+	}
+
+	return db.scanIndex(appendEscaped(bytes.Clone(idx.prefix), prefix, false), fn)
+}
+
+var errStopScan = errors.New("stop scan")
+
+func (db DB[T]) scanIndex(prefix []byte, fn func(key []byte, v T) error) (err error) {
+	return iteratePrefix(db.b.raw, prefix, func(_, value []byte) (err error) {
+		key := bytes.Clone(value)
+
+		v, err := db.Get(key)
+		if err == ErrNotFound {
+			// deleted since we read the index
+			return nil
+		} else if err != nil {
+			return
+		}
+
+		return fn(key, v)
+	})
+}
+
+// RebuildIndexes recomputes the given indexes (all if none given) from the values in the DB.
+func (db DB[T]) RebuildIndexes(names ...string) (err error) {
+	db.b.l.Lock()
+	defer db.b.l.Unlock()
+
+	indexes := db.s.indexes
+	if len(names) != 0 {
+		indexes = make([]*index[T], 0, len(names))
+		for _, name := range names {
+			idx := db.s.index(name)
+			if idx == nil {
+				return fmt.Errorf("%w: %q", ErrNoSuchIndex, name)
+			}
+			indexes = append(indexes, idx)
+		}
+	}
+
+	return db.s.rebuildIndexes(indexes)
+}
+
+// rebuildIndexes recomputes the indexes from the values. Must be called with the write lock held.
+func (s *dbState[T]) rebuildIndexes(indexes []*index[T]) (err error) {
+	db := DB[T]{b: s.b, s: s}
+
+	batch := db.b.raw.NewBatch()
+	defer batch.Close()
+
+	version := db.b.schema.Load().version()
+
+	for _, idx := range indexes {
+		if err = batch.DeleteRange(idx.prefix, prefixEnd(idx.prefix), nil); err != nil {
+			return
+		}
+		if err = setIndexVersion(batch, idx.name, version); err != nil {
+			return
+		}
+	}
+
+	owners := map[string][]byte{}
+
+	err = iterateUser(db.b.raw, nil, nil, func(key, data []byte) (err error) {
+		expired, err := db.b.expired(db.b.raw, key)
+		if err != nil || expired {
+			return
+		}
+
+		var v T
+		if err = db.decodeStored(key, data, &v); err != nil {
+			return fmt.Errorf("key %q: %w", key, err)
+		}
+
+		for _, idx := range indexes {
+			for _, indexKey := range idx.keys(v) {
+				entryKey := idx.entryKey(indexKey, key)
+
+				if idx.unique {
+					if owner, ok := owners[string(entryKey)]; ok && !bytes.Equal(owner, key) {
+						return ConflictError{Index: idx.name, Key: bytes.Clone(indexKey), Owner: owner}
+					}
+					owners[string(entryKey)] = bytes.Clone(key)
+				}
+
+				if err = batch.Set(entryKey, key, nil); err != nil {
+					return
+				}
+			}
+		}
+		return
+	})
+	if err != nil {
+		return
+	}
+
+	return batch.Commit(nil)
+}
@@ -0,0 +1,175 @@
+package localdb
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+type testUser struct {
+	Email string
+	Tags  []string
+}
+
+func userEmail(u testUser) [][]byte {
+	return [][]byte{[]byte(u.Email)}
+}
+
+func userTags(u testUser) (keys [][]byte) {
+	for _, tag := range u.Tags {
+		keys = append(keys, []byte(tag))
+	}
+	return
+}
+
+func TestIndexRedeclare(t *testing.T) {
+	db := openTest[testUser](t)
+	if err := db.AddUniqueIndex("email", userEmail); err != nil {
+		t.Fatal(err)
+	}
+
+	// a second Open of the bucket declares the same indexes
+	db2 := openTest[testUser](t)
+	if err := db2.AddUniqueIndex("email", userEmail); err != nil {
+		t.Errorf("same declaration should be accepted: %v", err)
+	}
+
+	if err := db2.AddIndex("email", userEmail); !errors.Is(err, ErrIndexDefined) {
+		t.Errorf("expected ErrIndexDefined for a non-unique redeclaration, got %v", err)
+	}
+	if err := db2.AddUniqueIndex("email", userTags); !errors.Is(err, ErrIndexDefined) {
+		t.Errorf("expected ErrIndexDefined for other keys, got %v", err)
+	}
+}
+
+func scanKeys(t *testing.T, db DB[testUser], index, prefix string) (keys []string) {
+	t.Helper()
+
+	err := db.ScanBy(index, []byte(prefix), func(key []byte, _ testUser) error {
+		keys = append(keys, string(key))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestIndex(t *testing.T) {
+	db := openTest[testUser](t)
+	if err := db.AddUniqueIndex("email", userEmail); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddIndex("tags", userTags); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, u := range map[string]testUser{
+		"u1": {Email: "a@x", Tags: []string{"admin", "dev"}},
+		"u2": {Email: "b@x", Tags: []string{"dev"}},
+		"u3": {Email: "c@x", Tags: []string{"ops"}},
+	} {
+		if err := db.Set([]byte(key), u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	key, u, err := db.GetBy("email", []byte("b@x"))
+	if err != nil || string(key) != "u2" || u.Email != "b@x" {
+		t.Errorf("GetBy: got %q, %+v, %v", key, u, err)
+	}
+	if _, _, err = db.GetBy("email", []byte("b@")); err != ErrNotFound {
+		t.Errorf("GetBy should only match whole keys, got %v", err)
+	}
+
+	if keys := scanKeys(t, db, "tags", "dev"); fmt.Sprint(keys) != "[u1 u2]" {
+		t.Errorf("ScanBy dev: %v", keys)
+	}
+	if keys := scanKeys(t, db, "tags", ""); fmt.Sprint(keys) != "[u1 u1 u2 u3]" {
+		t.Errorf("ScanBy all: %v", keys)
+	}
+
+	// updates and deletes remove the previous entries
+	if err = db.Set([]byte("u1"), testUser{Email: "a2@x", Tags: []string{"ops"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Delete([]byte("u2")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err = db.GetBy("email", []byte("a@x")); err != ErrNotFound {
+		t.Errorf("old email should not be indexed anymore, got %v", err)
+	}
+	if keys := scanKeys(t, db, "tags", "dev"); len(keys) != 0 {
+		t.Errorf("ScanBy dev after update: %v", keys)
+	}
+	if keys := scanKeys(t, db, "tags", "ops"); fmt.Sprint(keys) != "[u1 u3]" {
+		t.Errorf("ScanBy ops after update: %v", keys)
+	}
+
+	if _, _, err = db.GetBy("nope", nil); !errors.Is(err, ErrNoSuchIndex) {
+		t.Errorf("expected ErrNoSuchIndex, got %v", err)
+	}
+}
+
+func TestUniqueIndex(t *testing.T) {
+	db := openTest[testUser](t)
+	if err := db.AddUniqueIndex("email", userEmail); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Set([]byte("u1"), testUser{Email: "a@x"}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := db.Set([]byte("u2"), testUser{Email: "a@x"})
+
+	conflict := ConflictError{}
+	if !errors.As(err, &conflict) || conflict.Index != "email" || string(conflict.Owner) != "u1" {
+		t.Fatalf("expected a conflict with u1, got %v", err)
+	}
+	if ok, _ := db.Has([]byte("u2")); ok {
+		t.Error("the conflicting value should not be written")
+	}
+
+	// the owner can rewrite its key, and it's free again once the owner changed
+	if err = db.Set([]byte("u1"), testUser{Email: "a@x", Tags: []string{"dev"}}); err != nil {
+		t.Error(err)
+	}
+	if err = db.Set([]byte("u1"), testUser{Email: "b@x"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set([]byte("u2"), testUser{Email: "a@x"}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRebuildIndexes(t *testing.T) {
+	db := openTest[testUser](t)
+
+	for key, email := range map[string]string{"u1": "a@x", "u2": "b@x"} {
+		if err := db.Set([]byte(key), testUser{Email: email}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// built when first declared
+	if err := db.AddUniqueIndex("email", userEmail); err != nil {
+		t.Fatal(err)
+	}
+	if key, _, err := db.GetBy("email", []byte("a@x")); err != nil || string(key) != "u1" {
+		t.Errorf("GetBy after declaration: got %q, %v", key, err)
+	}
+
+	if err := db.RebuildIndexes(); err != nil {
+		t.Fatal(err)
+	}
+
+	if key, _, err := db.GetBy("email", []byte("b@x")); err != nil || string(key) != "u2" {
+		t.Errorf("GetBy after rebuild: got %q, %v", key, err)
+	}
+
+	if err := db.RebuildIndexes("nope"); !errors.Is(err, ErrNoSuchIndex) {
+		t.Errorf("expected ErrNoSuchIndex, got %v", err)
+	}
+}
@@ -0,0 +1,94 @@
+package localdb
+
+import (
+	"bytes"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// Scan calls fn for each value having a key starting with prefix, in key order.
+func (db DB[T]) Scan(prefix []byte, fn func(key []byte, v T) error) (err error) {
+	return db.scan(prefix, prefixEnd(prefix), fn)
+}
+
+func (db DB[T]) scan(lower, upper []byte, fn func(key []byte, v T) error) (err error) {
+	return iterateUser(db.b.raw, lower, upper, func(key, data []byte) (err error) {
+		expired, err := db.b.expired(db.b.raw, key)
+		if err != nil || expired {
+			return
+		}
+
+		var v T
+		if err = db.decodeStored(key, data, &v); err != nil {
+			return
+		}
+
+		return fn(bytes.Clone(key), v)
+	})
+}
+
+type iterReader interface {
+	NewIter(o *pebble.IterOptions) (*pebble.Iterator, error)
+}
+
+// iterate calls fn for each key/value in [lower, upper). Key and value are only valid during the call.
+func iterate(r iterReader, lower, upper []byte, fn func(key, value []byte) error) (err error) {
+	if upper != nil && bytes.Compare(lower, upper) >= 0 {
+		return
+	}
+
+	iter, err := r.NewIter(&pebble.IterOptions{
+		LowerBound: lower,
+		UpperBound: upper,
+	})
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if closeErr := iter.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	for iter.First(); iter.Valid(); iter.Next() {
+		if err = fn(iter.Key(), iter.Value()); err != nil {
+			return
+		}
+	}
+
+	return iter.Error()
+}
+
+func iteratePrefix(r iterReader, prefix []byte, fn func(key, value []byte) error) (err error) {
+	return iterate(r, prefix, prefixEnd(prefix), fn)
+}
+
+// iterateUser is like iterate but skips the keys reserved by localdb.
+func iterateUser(r iterReader, lower, upper []byte, fn func(key, value []byte) error) (err error) {
+	sysEnd := prefixEnd(sysPrefix)
+
+	// the part before the reserved range
+	if bytes.Compare(lower, sysPrefix) < 0 {
+		end := upper
+		if upper == nil || bytes.Compare(upper, sysPrefix) > 0 {
+			end = sysPrefix
+		}
+
+		if err = iterate(r, lower, end, fn); err != nil {
+			return
+		}
+	}
+
+	// the part after the reserved range
+	if upper == nil || bytes.Compare(upper, sysEnd) > 0 {
+		start := lower
+		if bytes.Compare(lower, sysEnd) < 0 {
+			start = sysEnd
+		}
+
+		return iterate(r, start, upper, fn)
+	}
+
+	return
+}
@@ -0,0 +1,274 @@
+package localdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// ErrInvalidKey is returned when decoding an invalid key, or writing a key reserved by localdb (starting with
+// "\x00\x00localdb\x00").
+var ErrInvalidKey = errors.New("invalid key")
+
+// KeyCodec encodes keys in an order-preserving and self-delimiting form, so encoded keys sort like the keys
+// themselves and can be concatenated to build composite keys.
+type KeyCodec[K any] interface {
+	AppendKey(dst []byte, k K) []byte
+	DecodeKey(src []byte) (k K, rest []byte, err error)
+}
+
+type StringKey struct{}
+
+var _ KeyCodec[string] = StringKey{}
+
+func (StringKey) AppendKey(dst []byte, k string) []byte {
+	return appendEscaped(dst, []byte(k), true)
+}
+
+func (StringKey) DecodeKey(src []byte) (k string, rest []byte, err error) {
+	buf := make([]byte, 0, len(src))
+	for i := 0; i < len(src); i++ {
+		if src[i] != 0 {
+			buf = append(buf, src[i])
+			continue
+		}
+
+		if i+1 == len(src) {
+			break
+		}
+
+		switch src[i+1] {
+		case 0xff:
+			buf = append(buf, 0)
+			i++
+		case 1:
+			return string(buf), src[i+2:], nil
+		default:
+			err = ErrInvalidKey
+			return
+		}
+	}
+
+	err = ErrInvalidKey
+	return
+}
+
+type signed interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64
+}
+
+type unsigned interface {
+	~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr
+}
+
+// IntKey encodes signed integers as 8 bytes, with the sign bit flipped so negative values sort first.
+type IntKey[I signed] struct{}
+
+func (IntKey[I]) AppendKey(dst []byte, k I) []byte {
+	return binary.BigEndian.AppendUint64(dst, uint64(k)^(1<<63))
+}
+
+func (IntKey[I]) DecodeKey(src []byte) (k I, rest []byte, err error) {
+	if len(src) < 8 {
+		err = ErrInvalidKey
+		return
+	}
+	return I(int64(binary.BigEndian.Uint64(src) ^ (1 << 63))), src[8:], nil
+}
+
+// UintKey encodes unsigned integers as 8 bytes.
+type UintKey[U unsigned] struct{}
+
+func (UintKey[U]) AppendKey(dst []byte, k U) []byte {
+	return binary.BigEndian.AppendUint64(dst, uint64(k))
+}
+
+func (UintKey[U]) DecodeKey(src []byte) (k U, rest []byte, err error) {
+	if len(src) < 8 {
+		err = ErrInvalidKey
+		return
+	}
+	return U(binary.BigEndian.Uint64(src)), src[8:], nil
+}
+
+// TimeKey encodes times as their Unix time in nanoseconds, so it only supports years 1678 to 2262.
+// The location is not encoded, decoded times are in UTC.
+type TimeKey struct{}
+
+var _ KeyCodec[time.Time] = TimeKey{}
+
+func (TimeKey) AppendKey(dst []byte, k time.Time) []byte {
+	return IntKey[int64]{}.AppendKey(dst, k.UnixNano())
+}
+
+func (TimeKey) DecodeKey(src []byte) (k time.Time, rest []byte, err error) {
+	ns, rest, err := IntKey[int64]{}.DecodeKey(src)
+	if err != nil {
+		return
+	}
+	return time.Unix(0, ns).UTC(), rest, nil
+}
+
+// UUIDKey encodes 16 bytes UUIDs as is.
+type UUIDKey struct{}
+
+var _ KeyCodec[[16]byte] = UUIDKey{}
+
+func (UUIDKey) AppendKey(dst []byte, k [16]byte) []byte {
+	return append(dst, k[:]...)
+}
+
+func (UUIDKey) DecodeKey(src []byte) (k [16]byte, rest []byte, err error) {
+	if len(src) < len(k) {
+		err = ErrInvalidKey
+		return
+	}
+	copy(k[:], src)
+	return k, src[len(k):], nil
+}
+
+type Tuple2[A, B any] struct {
+	A A
+	B B
+}
+
+type tuple2Key[A, B any] struct {
+	a KeyCodec[A]
+	b KeyCodec[B]
+}
+
+// Tuple2Key encodes pairs, sorted by their first then second element.
+func Tuple2Key[A, B any](a KeyCodec[A], b KeyCodec[B]) KeyCodec[Tuple2[A, B]] {
+	return tuple2Key[A, B]{a, b}
+}
+
+func (c tuple2Key[A, B]) AppendKey(dst []byte, k Tuple2[A, B]) []byte {
+	return c.b.AppendKey(c.a.AppendKey(dst, k.A), k.B)
+}
+
+func (c tuple2Key[A, B]) DecodeKey(src []byte) (k Tuple2[A, B], rest []byte, err error) {
+	if k.A, rest, err = c.a.DecodeKey(src); err != nil {
+		return
+	}
+	k.B, rest, err = c.b.DecodeKey(rest)
+	return
+}
+
+type Tuple3[A, B, C any] struct {
+	A A
+	B B
+	C C
+}
+
+type tuple3Key[A, B, C any] struct {
+	a KeyCodec[A]
+	b KeyCodec[B]
+	c KeyCodec[C]
+}
+
+// Tuple3Key encodes triples, sorted by their first, second then third element.
+func Tuple3Key[A, B, C any](a KeyCodec[A], b KeyCodec[B], c KeyCodec[C]) KeyCodec[Tuple3[A, B, C]] {
+	return tuple3Key[A, B, C]{a, b, c}
+}
+
+func (c tuple3Key[A, B, C]) AppendKey(dst []byte, k Tuple3[A, B, C]) []byte {
+	return c.c.AppendKey(c.b.AppendKey(c.a.AppendKey(dst, k.A), k.B), k.C)
+}
+
+func (c tuple3Key[A, B, C]) DecodeKey(src []byte) (k Tuple3[A, B, C], rest []byte, err error) {
+	if k.A, rest, err = c.a.DecodeKey(src); err != nil {
+		return
+	}
+	if k.B, rest, err = c.b.DecodeKey(rest); err != nil {
+		return
+	}
+	k.C, rest, err = c.c.DecodeKey(rest)
+	return
+}
+
+func encodeKey[K any](codec KeyCodec[K], k K) []byte {
+	return codec.AppendKey(nil, k)
+}
+
+func decodeKey[K any](codec KeyCodec[K], src []byte) (k K, err error) {
+	k, rest, err := codec.DecodeKey(src)
+	if err == nil && len(rest) != 0 {
+		err = ErrInvalidKey
+	}
+	return
+}
+
+// Keyed is a DB with typed keys.
+type Keyed[K any, T any] struct {
+	DB[T]
+	Keys KeyCodec[K]
+}
+
+func OpenKeyed[K any, T any](bucket string, keys KeyCodec[K], opts ...Option) (db Keyed[K, T], err error) {
+	db.DB, err = Open[T](bucket, opts...)
+	db.Keys = keys
+	return
+}
+
+func (db Keyed[K, T]) Has(k K) (ok bool, err error) {
+	return db.DB.Has(encodeKey(db.Keys, k))
+}
+
+func (db Keyed[K, T]) Get(k K) (v T, err error) {
+	return db.DB.Get(encodeKey(db.Keys, k))
+}
+
+func (db Keyed[K, T]) Set(k K, v T) (err error) {
+	return db.DB.Set(encodeKey(db.Keys, k), v)
+}
+
+func (db Keyed[K, T]) SetWithTTL(k K, v T, ttl time.Duration) (err error) {
+	return db.DB.SetWithTTL(encodeKey(db.Keys, k), v, ttl)
+}
+
+func (db Keyed[K, T]) Delete(k K) (err error) {
+	return db.DB.Delete(encodeKey(db.Keys, k))
+}
+
+// Range calls fn for each value with a key in [from, to), in key order.
+func (db Keyed[K, T]) Range(from, to K, fn func(k K, v T) error) (err error) {
+	return db.scan(encodeKey(db.Keys, from), encodeKey(db.Keys, to), fn)
+}
+
+// ScanPrefix calls fn for each value with an encoded key starting with prefix, in key order.
+// With composite keys, the prefix is usually the encoding of the first elements (ie StringKey{}.AppendKey(nil, tenant)).
+func (db Keyed[K, T]) ScanPrefix(prefix []byte, fn func(k K, v T) error) (err error) {
+	return db.scan(prefix, prefixEnd(prefix), fn)
+}
+
+func (db Keyed[K, T]) scan(lower, upper []byte, fn func(k K, v T) error) (err error) {
+	return db.DB.scan(lower, upper, func(key []byte, v T) (err error) {
+		k, err := decodeKey(db.Keys, key)
+		if err != nil {
+			return
+		}
+		return fn(k, v)
+	})
+}
+
+// GetBy is like DB.GetBy but returns a typed key.
+func (db Keyed[K, T]) GetBy(index string, indexKey []byte) (k K, v T, err error) {
+	key, v, err := db.DB.GetBy(index, indexKey)
+	if err != nil {
+		return
+	}
+
+	k, err = decodeKey(db.Keys, key)
+	return
+}
+
+// ScanBy is like DB.ScanBy but gives typed keys.
+func (db Keyed[K, T]) ScanBy(index string, prefix []byte, fn func(k K, v T) error) (err error) {
+	return db.DB.ScanBy(index, prefix, func(key []byte, v T) (err error) {
+		k, err := decodeKey(db.Keys, key)
+		if err != nil {
+			return
+		}
+		return fn(k, v)
+	})
+}
@@ -0,0 +1,94 @@
+package localdb
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func checkKeyOrder[K any](t *testing.T, codec KeyCodec[K], sorted []K) {
+	t.Helper()
+
+	var prev []byte
+	for i, k := range sorted {
+		ba := encodeKey(codec, k)
+
+		if i != 0 && bytes.Compare(prev, ba) >= 0 {
+			t.Errorf("%v: encoded key %x should be after %x", k, ba, prev)
+		}
+		prev = ba
+
+		decoded, err := decodeKey(codec, ba)
+		if err != nil {
+			t.Errorf("%v: decode failed: %v", k, err)
+		} else if fmt.Sprint(decoded) != fmt.Sprint(k) {
+			t.Errorf("%v: decoded as %v", k, decoded)
+		}
+	}
+}
+
+func TestStringKeyOrder(t *testing.T) {
+	checkKeyOrder[string](t, StringKey{}, []string{"", "\x00", "\x00\x00", "\x00\x01", "a", "a\x00", "a\x00b", "ab", "b"})
+}
+
+func TestIntKeyOrder(t *testing.T) {
+	checkKeyOrder[int64](t, IntKey[int64]{}, []int64{math.MinInt64, -256, -1, 0, 1, 256, math.MaxInt64})
+	checkKeyOrder[int8](t, IntKey[int8]{}, []int8{math.MinInt8, -1, 0, 1, math.MaxInt8})
+}
+
+func TestUintKeyOrder(t *testing.T) {
+	checkKeyOrder[uint64](t, UintKey[uint64]{}, []uint64{0, 1, 256, math.MaxUint64})
+}
+
+func TestTimeKeyOrder(t *testing.T) {
+	ref := time.Date(2023, 8, 9, 4, 11, 15, 0, time.UTC)
+	checkKeyOrder[time.Time](t, TimeKey{}, []time.Time{time.Unix(0, 0).UTC().Add(-time.Hour), time.Unix(0, 0).UTC(), ref, ref.Add(1)})
+}
+
+func TestTupleKeyOrder(t *testing.T) {
+	ref := time.Date(2023, 8, 9, 4, 11, 15, 0, time.UTC)
+
+	checkKeyOrder(t, Tuple2Key[string, time.Time](StringKey{}, TimeKey{}), []Tuple2[string, time.Time]{
+		{"a", ref},
+		{"a", ref.Add(time.Second)},
+		{"a\x00", ref.Add(-time.Second)},
+		{"ab", ref.Add(-time.Hour)},
+		{"b", ref},
+	})
+
+	checkKeyOrder(t, Tuple3Key[uint64, string, [16]byte](UintKey[uint64]{}, StringKey{}, UUIDKey{}), []Tuple3[uint64, string, [16]byte]{
+		{1, "a", [16]byte{1}},
+		{1, "a", [16]byte{2}},
+		{1, "b", [16]byte{}},
+		{2, "", [16]byte{}},
+	})
+}
+
+func TestKeyPrefix(t *testing.T) {
+	codec := Tuple2Key[string, int](StringKey{}, IntKey[int]{})
+	prefix := StringKey{}.AppendKey(nil, "a")
+
+	for _, k := range []Tuple2[string, int]{{"a", -1}, {"a", 5}} {
+		if !bytes.HasPrefix(encodeKey(codec, k), prefix) {
+			t.Errorf("%v should have prefix %x", k, prefix)
+		}
+	}
+	for _, k := range []Tuple2[string, int]{{"", 1}, {"a\x00", 1}, {"ab", 1}} {
+		if bytes.HasPrefix(encodeKey(codec, k), prefix) {
+			t.Errorf("%v should not have prefix %x", k, prefix)
+		}
+	}
+}
+
+func TestInvalidKeys(t *testing.T) {
+	for _, ba := range [][]byte{{'a'}, {'a', 0}, {'a', 0, 2}} {
+		if _, err := decodeKey[string](StringKey{}, ba); err == nil {
+			t.Errorf("%q should not decode as a string", ba)
+		}
+	}
+	if _, err := decodeKey[int64](IntKey[int64]{}, make([]byte, 9)); err == nil {
+		t.Error("trailing bytes should be rejected")
+	}
+}
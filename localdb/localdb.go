@@ -7,6 +7,8 @@ import (
 	"path/filepath"
 
 	"github.com/cockroachdb/pebble"
+
+	"m.cluseau.fr/go/memlog"
 )
 
 var (
@@ -20,13 +22,24 @@ func init() {
 }
 
 type DB[T any] struct {
-	raw *pebble.DB
+	b *bucket
+	s *dbState[T]
+}
+
+// dbState is the state of a bucket specific to a value type
+type dbState[T any] struct {
+	b *bucket
+
+	indexes []*index[T]
+
+	changes   *memlog.Memlog[Change[T]]
+	changeSeq uint64
 }
 
 func Exists(bucket string) (exists bool, err error) {
 	stat, err := os.Stat(filepath.Join(dbPath, bucket))
 	if os.IsNotExist(err) {
-		return
+		return false, nil
 	} else if err != nil {
 		return
 	}
@@ -35,13 +48,22 @@ func Exists(bucket string) (exists bool, err error) {
 	return
 }
 
-func Open[T any](bucket string) (db DB[T], err error) {
-	db.raw, err = pebble.Open(filepath.Join(dbPath, bucket), nil)
+// Open opens a bucket. Buckets are shared in the process: opening an already opened bucket returns a DB on the same
+// store, and DBs with the same value type also share their indexes and change feed. The options of the first Open
+// apply, except the schema which must be the same.
+func Open[T any](bucket string, opts ...Option) (db DB[T], err error) {
+	db.b, err = openBucket(bucket, buildOptions(opts))
+	if err != nil {
+		return
+	}
+
+	db.s = getView[T](db.b)
 	return
 }
 
+// Close releases the DB. The bucket is closed when all the DBs opened on it are closed.
 func (db DB[T]) Close() (err error) {
-	return db.raw.Close()
+	return db.b.release()
 }
 
 func (db DB[T]) Has(key []byte) (ok bool, err error) {
@@ -62,34 +84,92 @@ func (db DB[T]) Get(key []byte) (v T, err error) {
 }
 
 func (db DB[T]) GetRaw(key []byte, processData func(data []byte) error) (err error) {
-	data, closer, err := db.raw.Get(key)
+	return db.b.getRaw(key, processData)
+}
+
+func (db DB[T]) Set(key []byte, v T) (err error) {
+	data, err := json.Marshal(v)
 	if err != nil {
 		return
 	}
 
-	defer closer.Close()
-	err = processData(data)
+	return db.b.write(&mutation{key: key, data: data, v: &v})
+}
+
+func (db DB[T]) SetRaw(key []byte, data []byte) (err error) {
+	return db.b.write(&mutation{key: key, data: data})
+}
+
+func (db DB[T]) Delete(key []byte) (err error) {
+	return db.b.write(&mutation{key: key})
+}
+
+// getPtr is like Get but returns nil when the key is not found. It does not write, so it's safe to call with the write lock held.
+func (db DB[T]) getPtr(key []byte) (v *T, err error) {
+	expired, err := db.b.expired(db.b.raw, key)
+	if err != nil || expired {
+		return
+	}
+
+	data, err := db.b.getStored(db.b.raw, key)
+	if err != nil || data == nil {
+		return
+	}
+
+	v = new(T)
+	err = json.Unmarshal(data, v)
 	return
 }
 
-func (db DB[T]) Set(key []byte, v T) (err error) {
-	data, err := json.Marshal(v)
+// decodeStored decodes a value as read from the store, migrating it if needed.
+func (db DB[T]) decodeStored(key, data []byte, v *T) (err error) {
+	data, err = db.b.upgradeStored(db.b.raw, key, data)
 	if err != nil {
 		return
 	}
-
-	return db.SetRaw(key, data)
+	return json.Unmarshal(data, v)
 }
 
-func (db DB[T]) SetRaw(key []byte, data []byte) (err error) {
-	batch := db.raw.NewBatch()
+func (s *dbState[T]) needsValues() bool {
+	return len(s.indexes) != 0 || s.changes != nil
+}
 
-	if err = batch.Set(key, data, nil); err != nil {
+// prepare adds to the batch the changes of this value type for a mutation (index updates), and returns what to do
+// once the batch is committed. Must be called with the write lock held.
+func (s *dbState[T]) prepare(batch *pebble.Batch, m *mutation, prevData []byte, prevExpired bool) (committed func(), err error) {
+	if !s.needsValues() {
 		return
 	}
-	if err = batch.Commit(nil); err != nil {
+
+	var prev, v *T
+
+	if prevData != nil {
+		prev = new(T)
+		if err = json.Unmarshal(prevData, prev); err != nil {
+			return
+		}
+	}
+
+	if m.data != nil {
+		if typed, ok := m.v.(*T); ok {
+			v = typed
+		} else {
+			v = new(T)
+			if err = json.Unmarshal(m.data, v); err != nil {
+				return
+			}
+		}
+	}
+
+	if err = s.updateIndexes(batch, m.key, prev, v); err != nil {
 		return
 	}
 
+	old := prev
+	if prevExpired && v != nil {
+		// replacing an expired value creates the key again
+		old = nil
+	}
+	committed = func() { s.publishChange(m.key, old, v) }
 	return
 }
@@ -0,0 +1,77 @@
+package localdb
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "localdb-test-")
+	if err != nil {
+		panic(err)
+	}
+
+	dbPath = dir
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// tempDBPath makes the test use its own directory for on-disk buckets, so it can be repeated.
+func tempDBPath(t *testing.T) {
+	prev := dbPath
+	dbPath = t.TempDir()
+	t.Cleanup(func() { dbPath = prev })
+}
+
+// openTest opens an in-memory bucket named after the test, closed when the test ends.
+func openTest[T any](t *testing.T, opts ...Option) DB[T] {
+	t.Helper()
+
+	db, err := Open[T](t.Name(), append([]Option{InMemory()}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestInMemory(t *testing.T) {
+	db, err := Open[string](t.Name(), InMemory())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Set([]byte("a"), "A"); err != nil {
+		t.Fatal(err)
+	}
+
+	// shared while open
+	db2, err := Open[string](t.Name(), InMemory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db2.Get([]byte("a")); err != nil || v != "A" {
+		t.Errorf("got %q, %v", v, err)
+	}
+	db2.Close()
+
+	if exists, _ := Exists(t.Name()); exists {
+		t.Error("in-memory bucket should not be on disk")
+	}
+
+	// lost when closed by the last DB
+	db.Close()
+
+	db, err = Open[string](t.Name(), InMemory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Get([]byte("a")); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,339 @@
+package localdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+)
+
+const (
+	codecJSON = "json"
+
+	// migrateBatchSize is the number of values migrated per batch
+	migrateBatchSize = 1000
+)
+
+var (
+	ErrSchemaTooNew = errors.New("bucket schema is newer than the requested one")
+
+	metaKey          = sysKey("meta")
+	versionKeyPrefix = sysKey("ver", "")
+)
+
+// BucketMeta is the metadata record of a bucket.
+type BucketMeta struct {
+	SchemaVersion int       `json:"schemaVersion"`
+	Codec         string    `json:"codec"`
+	Created       time.Time `json:"created"`
+	// TTL is set once a key has been given an expiry
+	TTL bool `json:"ttl,omitempty"`
+}
+
+// Migration transforms a value from one schema version to the next.
+type Migration func(old []byte) ([]byte, error)
+
+// Schema describes the current version of the values in a bucket, and how to migrate older ones.
+type Schema struct {
+	Version int
+	// Migrations[v] migrates a value from version v to version v+1.
+	Migrations map[int]Migration
+	// Lazy migrates values when they are read, and stores them migrated when they are written, instead of migrating the
+	// whole bucket at Open.
+	Lazy bool
+}
+
+func (schema Schema) upgrade(data []byte, from int) (_ []byte, err error) {
+	for v := from; v < schema.Version; v++ {
+		migration := schema.Migrations[v]
+		if migration == nil {
+			return nil, fmt.Errorf("no migration from schema version %d", v)
+		}
+
+		data, err = migration(data)
+		if err != nil {
+			return nil, fmt.Errorf("migration from schema version %d failed: %w", v, err)
+		}
+	}
+	return data, nil
+}
+
+type MigrationReport struct {
+	FromVersion int
+	ToVersion   int
+	Total       int
+	Changed     int
+}
+
+func (db DB[T]) Meta() (meta BucketMeta, err error) {
+	found, err := getJSON(db.b.raw, metaKey, &meta)
+	if err == nil && !found {
+		err = ErrNotFound
+	}
+	return
+}
+
+func getJSON(r pebble.Reader, key []byte, v any) (found bool, err error) {
+	data, closer, err := r.Get(key)
+	if err == ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return
+	}
+
+	defer closer.Close()
+	return true, json.Unmarshal(data, v)
+}
+
+func setJSON(w pebble.Writer, key []byte, v any) (err error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	return w.Set(key, data, nil)
+}
+
+// readMeta returns the metadata of the bucket, or the metadata it should have if it has none yet.
+func readMeta(r pebble.Reader, schema *Schema) (meta BucketMeta, found bool, err error) {
+	found, err = getJSON(r, metaKey, &meta)
+	if err != nil || found {
+		return
+	}
+
+	meta = BucketMeta{Codec: codecJSON, Created: time.Now()}
+
+	// values of buckets created before metadata were at version 0, so only new buckets are at the current version
+	empty := true
+	err = iterateUser(r, nil, nil, func(_, _ []byte) error {
+		empty = false
+		return errStopScan
+	})
+	if err == errStopScan {
+		err = nil
+	}
+	if empty && schema != nil {
+		meta.SchemaVersion = schema.Version
+	}
+	return
+}
+
+// initSchema loads the bucket metadata at Open, running the migrations if needed.
+func (b *bucket) initSchema(schema *Schema) (err error) {
+	meta, found, err := readMeta(b.raw, schema)
+	if err != nil {
+		return
+	}
+
+	if meta.Codec != codecJSON {
+		return fmt.Errorf("unsupported codec: %q", meta.Codec)
+	}
+
+	b.hasTTL.Store(meta.TTL)
+
+	if schema == nil {
+		b.schema.Store(&schemaState{baseVersion: meta.SchemaVersion})
+
+		if !found && !b.readOnly {
+			err = setJSON(b.raw, metaKey, meta)
+		}
+		return
+	}
+
+	if meta.SchemaVersion > schema.Version {
+		return fmt.Errorf("%w (%d > %d)", ErrSchemaTooNew, meta.SchemaVersion, schema.Version)
+	}
+
+	b.schema.Store(&schemaState{schema: schema, baseVersion: meta.SchemaVersion})
+
+	if meta.SchemaVersion == schema.Version || schema.Lazy {
+		if !found {
+			err = setJSON(b.raw, metaKey, meta)
+		}
+		return
+	}
+
+	report, err := b.migrateAll(meta)
+	if err != nil {
+		return
+	}
+
+	log.Printf("localdb: bucket %q: migrated %d/%d records from schema version %d to %d",
+		b.name, report.Changed, report.Total, report.FromVersion, report.ToVersion)
+	return
+}
+
+// schemaState is the schema of an open bucket. It's replaced as a whole so it can be read without the write lock.
+type schemaState struct {
+	schema *Schema
+	// baseVersion is the version of the values without a version marker
+	baseVersion int
+}
+
+// pending tells if some values may be at a version older than the schema.
+func (st *schemaState) pending() bool {
+	return st.schema != nil && st.baseVersion < st.schema.Version
+}
+
+// version is the schema version of the values, once migrated.
+func (st *schemaState) version() int {
+	if st.schema == nil {
+		return st.baseVersion
+	}
+	return st.schema.Version
+}
+
+// migrateAll migrates the values in batches of migrateBatchSize. Migrated values get a version marker, so an
+// interrupted migration is resumed at the next Open. The indexes are left built for the previous version, so they are
+// rebuilt from the migrated values. Must be called with the write lock held (or before the bucket is shared).
+func (b *bucket) migrateAll(meta BucketMeta) (report MigrationReport, err error) {
+	schema := b.schema.Load().schema
+
+	mutations := make([]*mutation, 0, migrateBatchSize)
+	flush := func() (err error) {
+		if len(mutations) == 0 {
+			return
+		}
+		err = b.writeLocked(mutations...)
+		mutations = mutations[:0]
+		return
+	}
+
+	report, err = migrateRecords(b.raw, schema, meta.SchemaVersion, func(key, data []byte) error {
+		mutations = append(mutations, &mutation{key: bytes.Clone(key), data: data, migrated: true})
+		if len(mutations) == migrateBatchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return
+	}
+
+	batch := b.raw.NewBatch()
+	defer batch.Close()
+
+	if err = batch.DeleteRange(versionKeyPrefix, prefixEnd(versionKeyPrefix), nil); err != nil {
+		return
+	}
+
+	meta.SchemaVersion = schema.Version
+	if err = setJSON(batch, metaKey, meta); err != nil {
+		return
+	}
+
+	if err = batch.Commit(nil); err != nil {
+		return
+	}
+
+	b.schema.Store(&schemaState{schema: schema, baseVersion: meta.SchemaVersion})
+	return
+}
+
+// migrateRecords migrates every value of the bucket, calling changed for each value modified by the migration.
+func migrateRecords(r pebble.Reader, schema *Schema, baseVersion int, changed func(key, data []byte) error) (report MigrationReport, err error) {
+	report.FromVersion = baseVersion
+	report.ToVersion = schema.Version
+
+	err = iterateUser(r, nil, nil, func(key, data []byte) (err error) {
+		report.Total++
+
+		version, err := recordVersion(r, key, baseVersion)
+		if err != nil {
+			return
+		}
+
+		newData, err := schema.upgrade(data, version)
+		if err != nil {
+			return fmt.Errorf("key %q: %w", key, err)
+		}
+
+		if bytes.Equal(newData, data) {
+			return
+		}
+
+		report.Changed++
+		return changed(key, newData)
+	})
+	return
+}
+
+// DryRunMigration reports what opening the bucket with the given schema would migrate, without changing it.
+func DryRunMigration(bucket string, schema Schema) (report MigrationReport, err error) {
+	raw, closeReader, err := openBucketReader(bucket)
+	if err != nil {
+		return
+	}
+
+	defer closeReader()
+
+	meta, _, err := readMeta(raw, &schema)
+	if err != nil {
+		return
+	}
+
+	if meta.SchemaVersion > schema.Version {
+		err = fmt.Errorf("%w (%d > %d)", ErrSchemaTooNew, meta.SchemaVersion, schema.Version)
+		return
+	}
+
+	return migrateRecords(raw, &schema, meta.SchemaVersion, func(_, _ []byte) error { return nil })
+}
+
+func versionKey(key []byte) []byte {
+	return concat(versionKeyPrefix, key)
+}
+
+// recordVersion returns the schema version of a value, given by its version marker when it has been lazily migrated.
+func recordVersion(r pebble.Reader, key []byte, baseVersion int) (version int, err error) {
+	data, closer, err := r.Get(versionKey(key))
+	if err == ErrNotFound {
+		return baseVersion, nil
+	} else if err != nil {
+		return
+	}
+
+	defer closer.Close()
+
+	if len(data) != 4 {
+		err = fmt.Errorf("key %q: invalid version marker", key)
+		return
+	}
+	return int(binary.BigEndian.Uint32(data)), nil
+}
+
+// upgradeStored returns the value of key, as read from r, migrated to the current schema version.
+func (b *bucket) upgradeStored(r pebble.Reader, key, data []byte) (_ []byte, err error) {
+	st := b.schema.Load()
+	if !st.pending() {
+		return data, nil
+	}
+
+	version, err := recordVersion(r, key, st.baseVersion)
+	if err != nil {
+		return
+	}
+
+	return st.schema.upgrade(data, version)
+}
+
+// writeVersion adds to the batch the version marker of a written value. Must be called with the write lock held.
+func (b *bucket) writeVersion(batch *pebble.Batch, key []byte, deleted bool) (err error) {
+	st := b.schema.Load()
+	if !st.pending() {
+		return
+	}
+
+	if deleted {
+		return batch.Delete(versionKey(key), nil)
+	}
+
+	return batch.Set(versionKey(key), binary.BigEndian.AppendUint32(nil, uint32(st.schema.Version)), nil)
+}
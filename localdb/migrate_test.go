@@ -0,0 +1,291 @@
+package localdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+var userSchemaV2 = Schema{
+	Version: 2,
+	Migrations: map[int]Migration{
+		1: func(old []byte) ([]byte, error) {
+			v := testUser{}
+			if err := json.Unmarshal(old, &v); err != nil {
+				return nil, err
+			}
+			v.Email = "new-" + v.Email
+			return json.Marshal(v)
+		},
+	},
+}
+
+// writeUsersV1 writes n users at schema version 1 in an on-disk bucket, with an email index.
+func writeUsersV1(t *testing.T, n int) {
+	t.Helper()
+
+	db, err := Open[testUser](t.Name(), WithSchema(Schema{Version: 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err = db.AddUniqueIndex("email", userEmail); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < n; i++ {
+		if err = db.Set([]byte(fmt.Sprintf("u%04d", i)), testUser{Email: fmt.Sprint(i, "@x")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMigrateAll(t *testing.T) {
+	tempDBPath(t)
+
+	n := 2*migrateBatchSize + 10
+	writeUsersV1(t, n)
+
+	report, err := DryRunMigration(t.Name(), userSchemaV2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Total != n || report.Changed != n || report.FromVersion != 1 || report.ToVersion != 2 {
+		t.Errorf("unexpected dry run report: %+v", report)
+	}
+
+	db, err := Open[testUser](t.Name(), WithSchema(userSchemaV2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if meta, err := db.Meta(); err != nil || meta.SchemaVersion != 2 {
+		t.Errorf("meta: %+v, %v", meta, err)
+	}
+
+	if u, err := db.Get([]byte("u0042")); err != nil || u.Email != "new-42@x" {
+		t.Errorf("u0042: %+v, %v", u, err)
+	}
+
+	markers := 0
+	iteratePrefix(db.b.raw, versionKeyPrefix, func(_, _ []byte) error {
+		markers++
+		return nil
+	})
+	if markers != 0 {
+		t.Errorf("%d version markers left after the migration", markers)
+	}
+
+	// the index was built for version 1, so it's rebuilt from the migrated values
+	if err = db.AddUniqueIndex("email", userEmail); err != nil {
+		t.Fatal(err)
+	}
+	if key, _, err := db.GetBy("email", []byte("new-42@x")); err != nil || string(key) != "u0042" {
+		t.Errorf("GetBy new email: %q, %v", key, err)
+	}
+	if _, _, err := db.GetBy("email", []byte("42@x")); err != ErrNotFound {
+		t.Errorf("old email should not be indexed anymore, got %v", err)
+	}
+}
+
+func TestMigrateSharedBucket(t *testing.T) {
+	tempDBPath(t)
+
+	writeUsersV1(t, 3)
+
+	// opened without schema, with the index declared
+	db, err := Open[testUser](t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err = db.AddUniqueIndex("email", userEmail); err != nil {
+		t.Fatal(err)
+	}
+
+	// opened again with the schema: the migration goes through the declared index
+	db2, err := Open[testUser](t.Name(), WithSchema(userSchemaV2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close()
+
+	if key, _, err := db.GetBy("email", []byte("new-1@x")); err != nil || string(key) != "u0001" {
+		t.Errorf("GetBy new email: %q, %v", key, err)
+	}
+	if _, _, err := db.GetBy("email", []byte("1@x")); err != ErrNotFound {
+		t.Errorf("old email should not be indexed anymore, got %v", err)
+	}
+	if err = db.Set([]byte("u0002"), testUser{Email: "1@x"}); err != nil {
+		t.Errorf("the old email should be free: %v", err)
+	}
+}
+
+func TestLazyMigration(t *testing.T) {
+	tempDBPath(t)
+
+	writeUsersV1(t, 3)
+
+	clock := time.Date(2023, 8, 9, 0, 0, 0, 0, time.UTC)
+
+	{
+		db, err := Open[testUser](t.Name(), WithSchema(Schema{Version: 1}), WithClock(func() time.Time { return clock }))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.SetWithTTL([]byte("u0002"), testUser{Email: "2@x"}, time.Hour)
+		db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	schema := userSchemaV2
+	schema.Lazy = true
+
+	db, err := Open[testUser](t.Name(), WithSchema(schema), WithClock(func() time.Time { return clock }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err = db.AddUniqueIndex("email", userEmail); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	changes := db.Changes().Subscribe(stop)
+
+	for _, key := range []string{"u0001", "u0002"} {
+		if u, err := db.Get([]byte(key)); err != nil || u.Email != "new-"+key[4:]+"@x" {
+			t.Errorf("%s: %+v, %v", key, u, err)
+		}
+	}
+
+	if key, _, err := db.GetBy("email", []byte("new-1@x")); err != nil || string(key) != "u0001" {
+		t.Errorf("GetBy: %q, %v", key, err)
+	}
+	if _, _, err := db.GetBy("email", []byte("1@x")); err != ErrNotFound {
+		t.Errorf("old email should not be indexed anymore, got %v", err)
+	}
+
+	// migrations keep the expiry and don't publish changes
+	if ttl, err := db.TTL([]byte("u0002")); err != nil || ttl != time.Hour {
+		t.Errorf("TTL after migration: %v, %v", ttl, err)
+	}
+
+	select {
+	case c := <-changes:
+		t.Errorf("unexpected change: %+v", c)
+	default:
+	}
+
+	// reads don't write: the values are stored migrated when written
+	if version, err := recordVersion(db.b.raw, []byte("u0001"), 1); err != nil || version != 1 {
+		t.Errorf("u0001 should not be stored migrated yet: version %d, %v", version, err)
+	}
+	if err = db.Set([]byte("u0001"), testUser{Email: "other-1@x"}); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := recordVersion(db.b.raw, []byte("u0001"), 1); err != nil || version != 2 {
+		t.Errorf("u0001 should be stored migrated: version %d, %v", version, err)
+	}
+	if _, _, err := db.GetBy("email", []byte("new-1@x")); err != ErrNotFound {
+		t.Errorf("replaced email should not be indexed anymore, got %v", err)
+	}
+}
+
+type ageUser struct {
+	Email string
+	Age   int
+}
+
+func userAge(u ageUser) [][]byte {
+	return [][]byte{[]byte(fmt.Sprint(u.Age))}
+}
+
+func TestMigrateFieldType(t *testing.T) {
+	tempDBPath(t)
+
+	{
+		db, err := Open[json.RawMessage](t.Name(), WithSchema(Schema{Version: 1}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []string{"u1", "u2", "u3"} {
+			if err = db.SetRaw([]byte(key), []byte(`{"Email":"`+key+`@x","Age":"4`+key[1:]+`"}`)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		db.Close()
+	}
+
+	// the age was a string
+	schema := Schema{
+		Version: 2,
+		Lazy:    true,
+		Migrations: map[int]Migration{
+			1: func(old []byte) ([]byte, error) {
+				v := struct{ Email, Age string }{}
+				if err := json.Unmarshal(old, &v); err != nil {
+					return nil, err
+				}
+				u := ageUser{Email: v.Email}
+				_, err := fmt.Sscan(v.Age, &u.Age)
+				if err != nil {
+					return nil, err
+				}
+				return json.Marshal(u)
+			},
+		},
+	}
+
+	db, err := Open[ageUser](t.Name(), WithSchema(schema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err = db.AddIndex("age", userAge); err != nil {
+		t.Fatal(err)
+	}
+
+	if u, err := db.Get([]byte("u1")); err != nil || u.Age != 41 {
+		t.Errorf("u1: %+v, %v", u, err)
+	}
+	if err = db.Set([]byte("u1"), ageUser{Email: "u1@x", Age: 50}); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Delete([]byte("u2")); err != nil {
+		t.Fatal(err)
+	}
+
+	for age, expected := range map[string]string{"41": "", "42": "", "43": "u3", "50": "u1"} {
+		key, _, err := db.GetBy("age", []byte(age))
+		if expected == "" && err != ErrNotFound || expected != "" && (err != nil || string(key) != expected) {
+			t.Errorf("age %s: %q, %v, expected %q", age, key, err, expected)
+		}
+	}
+
+	// the remaining values are migrated at Open
+	db.Close()
+	schema.Lazy = false
+
+	db, err = Open[ageUser](t.Name(), WithSchema(schema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err = db.AddIndex("age", userAge); err != nil {
+		t.Fatal(err)
+	}
+	if key, u, err := db.GetBy("age", []byte("43")); err != nil || string(key) != "u3" || u.Email != "u3@x" {
+		t.Errorf("age 43: %q, %+v, %v", key, u, err)
+	}
+}
@@ -0,0 +1,45 @@
+package localdb
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/cockroachdb/pebble"
+
+	"m.cluseau.fr/go/memlog"
+)
+
+var offsetKeyPrefix = sysKey("offset", "")
+
+// OffsetStore stores the committed offsets of memlog consumer groups in the bucket.
+type OffsetStore struct {
+	b *bucket
+}
+
+var _ memlog.OffsetStore = OffsetStore{}
+
+// OffsetStore returns the memlog consumer group offsets stored in the bucket.
+func (db DB[T]) OffsetStore() OffsetStore {
+	return OffsetStore{db.b}
+}
+
+func (s OffsetStore) LoadOffset(group string) (seq uint64, found bool, err error) {
+	data, closer, err := s.b.raw.Get(concat(offsetKeyPrefix, []byte(group)))
+	if err == ErrNotFound {
+		return 0, false, nil
+	} else if err != nil {
+		return
+	}
+
+	defer closer.Close()
+
+	if len(data) != 8 {
+		err = fmt.Errorf("group %q: invalid offset", group)
+		return
+	}
+	return binary.BigEndian.Uint64(data), true, nil
+}
+
+func (s OffsetStore) SaveOffset(group string, seq uint64) (err error) {
+	return s.b.raw.Set(concat(offsetKeyPrefix, []byte(group)), binary.BigEndian.AppendUint64(nil, seq), pebble.NoSync)
+}
@@ -0,0 +1,71 @@
+package localdb
+
+import "time"
+
+type Option func(o *options)
+
+var defaultOptions []Option
+
+// SetDefaultOptions sets options applied to every Open before its own options.
+// It's meant to be called at init, ie to make tests use InMemory buckets.
+func SetDefaultOptions(opts ...Option) {
+	defaultOptions = opts
+}
+
+type options struct {
+	inMemory        bool
+	readOnly        bool
+	schema          *Schema
+	now             func() time.Time
+	janitorInterval time.Duration
+}
+
+func buildOptions(opts []Option) (o options) {
+	o.now = time.Now
+	o.janitorInterval = time.Minute
+
+	for _, opt := range defaultOptions {
+		opt(&o)
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return
+}
+
+// WithSchema declares the schema version of the values, migrating older values as the schema specifies.
+func WithSchema(schema Schema) Option {
+	return func(o *options) {
+		o.schema = &schema
+	}
+}
+
+// WithClock sets the clock used for expiries.
+func WithClock(now func() time.Time) Option {
+	return func(o *options) {
+		o.now = now
+	}
+}
+
+// WithJanitorInterval sets the interval between deletions of expired keys (1 minute by default).
+func WithJanitorInterval(interval time.Duration) Option {
+	return func(o *options) {
+		o.janitorInterval = interval
+	}
+}
+
+// readOnly opens the bucket read-only if it's not open yet. Such a bucket is not shared, and nothing is written to it,
+// not even its metadata.
+func readOnly() Option {
+	return func(o *options) {
+		o.readOnly = true
+	}
+}
+
+// InMemory makes the bucket live in memory instead of on disk. An in-memory bucket is shared while open,
+// and its content is lost when it's closed by its last DB.
+func InMemory() Option {
+	return func(o *options) {
+		o.inMemory = true
+	}
+}
@@ -0,0 +1,60 @@
+package localdb
+
+import "bytes"
+
+// sysPrefix prefixes the keys reserved for localdb's own records (indexes, metadata...)
+var sysPrefix = []byte("\x00\x00localdb\x00")
+
+func sysKey(parts ...string) (key []byte) {
+	key = append(key, sysPrefix...)
+	for i, part := range parts {
+		if i != 0 {
+			key = append(key, 0)
+		}
+		key = append(key, part...)
+	}
+	return
+}
+
+func isSysKey(key []byte) bool {
+	return bytes.HasPrefix(key, sysPrefix)
+}
+
+// prefixEnd returns the smallest key greater than every key with the given prefix (nil if none).
+func prefixEnd(prefix []byte) []byte {
+	end := bytes.Clone(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		end[i]++
+		if end[i] != 0 {
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+func concat(parts ...[]byte) (ba []byte) {
+	n := 0
+	for _, p := range parts {
+		n += len(p)
+	}
+	ba = make([]byte, 0, n)
+	for _, p := range parts {
+		ba = append(ba, p...)
+	}
+	return
+}
+
+// appendEscaped appends an order-preserving, self-delimiting form of ba to dst.
+// The terminator is omitted when terminate is false, which gives a valid prefix for scans.
+func appendEscaped(dst, ba []byte, terminate bool) []byte {
+	for _, b := range ba {
+		dst = append(dst, b)
+		if b == 0 {
+			dst = append(dst, 0xff)
+		}
+	}
+	if terminate {
+		dst = append(dst, 0, 1)
+	}
+	return dst
+}
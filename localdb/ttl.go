@@ -0,0 +1,256 @@
+package localdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+)
+
+const janitorBatchSize = 1000
+
+var (
+	// expiryKeyPrefix + key holds the expiry time of key
+	expiryKeyPrefix = sysKey("exp", "")
+	// expiryQueuePrefix + expiry time + key lists keys in expiry order
+	expiryQueuePrefix = sysKey("expq", "")
+)
+
+func expiryKey(key []byte) []byte {
+	return concat(expiryKeyPrefix, key)
+}
+
+func expiryQueueKey(expires uint64, key []byte) []byte {
+	return concat(binary.BigEndian.AppendUint64(bytes.Clone(expiryQueuePrefix), expires), key)
+}
+
+// SetWithTTL sets the value of key, which expires after ttl. Expired keys are not visible anymore and are deleted
+// in the background.
+func (db DB[T]) SetWithTTL(key []byte, v T, ttl time.Duration) (err error) {
+	if isSysKey(key) {
+		return ErrInvalidKey
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+
+	if err = db.b.enableTTL(); err != nil {
+		return
+	}
+
+	return db.b.write(&mutation{key: key, data: data, v: &v, expires: db.b.now().Add(ttl)})
+}
+
+// enableTTL records in the bucket metadata that expiries must be checked.
+func (b *bucket) enableTTL() (err error) {
+	if b.hasTTL.Load() {
+		return
+	}
+
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	if b.hasTTL.Load() {
+		return
+	}
+
+	meta, _, err := readMeta(b.raw, b.schema.Load().schema)
+	if err != nil {
+		return
+	}
+
+	meta.TTL = true
+	if err = setJSON(b.raw, metaKey, meta); err != nil {
+		return
+	}
+
+	b.hasTTL.Store(true)
+	b.startJanitor()
+	return
+}
+
+// TTL returns the remaining time before key expires, or 0 if it doesn't expire.
+func (db DB[T]) TTL(key []byte) (ttl time.Duration, err error) {
+	expires, ok, err := db.b.expiry(db.b.raw, key)
+	if err != nil || !ok {
+		return
+	}
+
+	ttl = time.Unix(0, int64(expires)).Sub(db.b.now())
+	if ttl <= 0 {
+		err = ErrNotFound
+	}
+	return
+}
+
+func (b *bucket) expiry(r pebble.Reader, key []byte) (expires uint64, ok bool, err error) {
+	if !b.hasTTL.Load() {
+		return
+	}
+
+	data, closer, err := r.Get(expiryKey(key))
+	if err == ErrNotFound {
+		return 0, false, nil
+	} else if err != nil {
+		return
+	}
+
+	defer closer.Close()
+
+	if len(data) != 8 {
+		err = fmt.Errorf("key %q: invalid expiry", key)
+		return
+	}
+	return binary.BigEndian.Uint64(data), true, nil
+}
+
+// expired tells if key, as seen from r, has expired. Expired keys must be seen as absent until they are deleted.
+func (b *bucket) expired(r pebble.Reader, key []byte) (expired bool, err error) {
+	expires, ok, err := b.expiry(r, key)
+	if err != nil || !ok {
+		return
+	}
+
+	return expires <= uint64(b.now().UnixNano()), nil
+}
+
+// writeExpiry adds to the batch the expiry changes of a written key. Must be called with the write lock held.
+func (b *bucket) writeExpiry(batch *pebble.Batch, key []byte, expires time.Time) (err error) {
+	prev, hadExpiry, err := b.expiry(batch, key)
+	if err != nil {
+		return
+	}
+
+	if hadExpiry {
+		if err = batch.Delete(expiryQueueKey(prev, key), nil); err != nil {
+			return
+		}
+		if expires.IsZero() {
+			if err = batch.Delete(expiryKey(key), nil); err != nil {
+				return
+			}
+		}
+	}
+
+	if expires.IsZero() {
+		return
+	}
+
+	ts := uint64(expires.UnixNano())
+
+	if err = batch.Set(expiryKey(key), binary.BigEndian.AppendUint64(nil, ts), nil); err != nil {
+		return
+	}
+	return batch.Set(expiryQueueKey(ts, key), nil, nil)
+}
+
+// DeleteExpired deletes the expired keys now, returning how many were deleted.
+func (db DB[T]) DeleteExpired() (n int, err error) {
+	return db.b.deleteExpired()
+}
+
+func (b *bucket) deleteExpired() (n int, err error) {
+	for {
+		var count int
+		count, err = b.deleteExpiredBatch()
+		n += count
+
+		if err != nil || count < janitorBatchSize {
+			return
+		}
+	}
+}
+
+func (b *bucket) deleteExpiredBatch() (n int, err error) {
+	if !b.hasTTL.Load() {
+		return
+	}
+
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	upper := expiryQueueKey(uint64(b.now().UnixNano())+1, nil)
+
+	mutations := make([]*mutation, 0)
+	err = iterate(b.raw, expiryQueuePrefix, upper, func(queueKey, _ []byte) (err error) {
+		ts := binary.BigEndian.Uint64(queueKey[len(expiryQueuePrefix):])
+		key := bytes.Clone(queueKey[len(expiryQueuePrefix)+8:])
+
+		expires, ok, err := b.expiry(b.raw, key)
+		if err != nil {
+			return
+		}
+		if !ok || expires != ts {
+			// stale entry, the key's expiry changed
+			return b.raw.Delete(queueKey, nil)
+		}
+
+		mutations = append(mutations, &mutation{key: key})
+
+		if len(mutations) == janitorBatchSize {
+			return errStopScan
+		}
+		return nil
+	})
+	if err == errStopScan {
+		err = nil
+	}
+	if err != nil || len(mutations) == 0 {
+		return
+	}
+
+	if err = b.writeLocked(mutations...); err != nil {
+		return
+	}
+
+	return len(mutations), nil
+}
+
+func (b *bucket) startJanitor() {
+	b.janitorOnce.Do(func() {
+		b.janitorDone = make(chan struct{})
+
+		go func() {
+			defer close(b.janitorDone)
+
+			ticker := time.NewTicker(b.janitorInterval)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-b.stopJanitorCh:
+					return
+
+				case <-ticker.C:
+					if _, err := b.deleteExpired(); err != nil {
+						log.Printf("localdb: bucket %q: failed to delete expired keys: %v", b.name, err)
+					}
+				}
+			}
+		}()
+	})
+}
+
+func (b *bucket) stopJanitor() {
+	b.l.Lock()
+	select {
+	case <-b.stopJanitorCh:
+		// already stopped
+	default:
+		close(b.stopJanitorCh)
+	}
+	b.l.Unlock()
+
+	// no janitor can start after stopJanitor is closed
+	b.janitorOnce.Do(func() {})
+
+	if b.janitorDone != nil {
+		<-b.janitorDone
+	}
+}
@@ -0,0 +1,168 @@
+package localdb
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testClock is a clock advanced by the tests.
+type testClock struct {
+	t atomic.Int64
+}
+
+func newTestClock() *testClock {
+	c := &testClock{}
+	c.t.Store(time.Date(2023, 8, 9, 0, 0, 0, 0, time.UTC).UnixNano())
+	return c
+}
+
+func (c *testClock) Now() time.Time {
+	return time.Unix(0, c.t.Load())
+}
+
+func (c *testClock) Add(d time.Duration) {
+	c.t.Add(int64(d))
+}
+
+func TestTTL(t *testing.T) {
+	clock := newTestClock()
+	db := openTest[string](t, WithClock(clock.Now), WithJanitorInterval(time.Hour))
+
+	if err := db.SetWithTTL([]byte("a"), "A", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set([]byte("b"), "B"); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := db.Get([]byte("a")); err != nil || v != "A" {
+		t.Errorf("before expiry: %q, %v", v, err)
+	}
+	if ttl, err := db.TTL([]byte("a")); err != nil || ttl != time.Minute {
+		t.Errorf("TTL: %v, %v", ttl, err)
+	}
+
+	clock.Add(time.Minute)
+
+	if _, err := db.Get([]byte("a")); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound after expiry, got %v", err)
+	}
+	if ok, err := db.Has([]byte("a")); err != nil || ok {
+		t.Errorf("Has after expiry: %v, %v", ok, err)
+	}
+	if _, err := db.TTL([]byte("a")); err != ErrNotFound {
+		t.Errorf("TTL after expiry: expected ErrNotFound, got %v", err)
+	}
+
+	keys := []string{}
+	db.Scan(nil, func(key []byte, _ string) error {
+		keys = append(keys, string(key))
+		return nil
+	})
+	if len(keys) != 1 || keys[0] != "b" {
+		t.Errorf("scan after expiry: %v", keys)
+	}
+
+	if n, err := db.DeleteExpired(); err != nil || n != 1 {
+		t.Errorf("DeleteExpired: %d, %v", n, err)
+	}
+	if _, _, err := db.b.raw.Get([]byte("a")); err != ErrNotFound {
+		t.Errorf("expired key should be deleted, got %v", err)
+	}
+
+	// a Set removes the expiry
+	db.SetWithTTL([]byte("c"), "C", time.Minute)
+	db.Set([]byte("c"), "C")
+	clock.Add(time.Hour)
+
+	if v, err := db.Get([]byte("c")); err != nil || v != "C" {
+		t.Errorf("after Set: %q, %v", v, err)
+	}
+}
+
+func TestTTLUniqueIndex(t *testing.T) {
+	clock := newTestClock()
+	db := openTest[testUser](t, WithClock(clock.Now), WithJanitorInterval(time.Hour))
+
+	if err := db.AddUniqueIndex("email", userEmail); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.SetWithTTL([]byte("u1"), testUser{Email: "a@x"}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Add(time.Minute)
+
+	if _, _, err := db.GetBy("email", []byte("a@x")); err != ErrNotFound {
+		t.Errorf("expired value found by index: %v", err)
+	}
+
+	// the expired owner doesn't hold the key anymore
+	if err := db.Set([]byte("u2"), testUser{Email: "a@x"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// deleting the expired value keeps the new owner's entry
+	if n, err := db.DeleteExpired(); err != nil || n != 1 {
+		t.Errorf("DeleteExpired: %d, %v", n, err)
+	}
+	if key, _, err := db.GetBy("email", []byte("a@x")); err != nil || string(key) != "u2" {
+		t.Errorf("GetBy: %q, %v", key, err)
+	}
+}
+
+func TestTTLChanges(t *testing.T) {
+	clock := newTestClock()
+	db := openTest[string](t, WithClock(clock.Now), WithJanitorInterval(time.Hour))
+
+	if err := db.SetWithTTL([]byte("k"), "a", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Add(time.Minute)
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	w, err := db.Bind([]byte("k"), stop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := w.Get(); v != "" {
+		t.Errorf("bound to an expired value: %q", v)
+	}
+
+	changes := db.SubscribeChanges(nil, stop)
+
+	if err = db.Set([]byte("k"), "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	// replacing an expired value is a creation
+	expectChanges(t, changes, "1 k: - -> b")
+}
+
+func TestJanitor(t *testing.T) {
+	clock := newTestClock()
+	db := openTest[string](t, WithClock(clock.Now), WithJanitorInterval(time.Millisecond))
+
+	if err := db.SetWithTTL([]byte("a"), "A", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Add(time.Minute)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, _, err := db.b.raw.Get([]byte("a"))
+		if err == ErrNotFound {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the janitor didn't delete the expired key")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,122 @@
+package memlog
+
+import (
+	"errors"
+	"sort"
+	"sync/atomic"
+)
+
+var ErrSlowConsumer = errors.New("subscriber lagging too far behind")
+
+// BackpressurePolicy is what a subscription does when its subscriber lags more than SubscribeOptions.MaxLag entries.
+type BackpressurePolicy int
+
+const (
+	// Block keeps the subscription where it is, whatever the lag (retaining all the entries from there).
+	Block BackpressurePolicy = iota
+	// DropAndNotify skips to the last appended entry, calling SubscribeOptions.OnDrop with the number of entries skipped.
+	DropAndNotify
+	// Disconnect ends the subscription with ErrSlowConsumer.
+	Disconnect
+)
+
+type SubscribeOptions struct {
+	// Name identifies the subscription in Subscribers
+	Name   string
+	Policy BackpressurePolicy
+	// MaxLag is the number of entries the subscriber can lag behind before the policy applies
+	MaxLag uint64
+	// OnDrop is called by the DropAndNotify policy, from the subscription's goroutine
+	OnDrop func(dropped uint64)
+}
+
+// SubscriberStats describes a subscription of a Memlog.
+type SubscriberStats struct {
+	Name   string
+	Policy BackpressurePolicy
+	// Seq is the sequence number of the next entry to deliver
+	Seq uint64
+	// Lag is the number of appended entries not delivered yet
+	Lag     uint64
+	Dropped uint64
+}
+
+type subscriber struct {
+	opts    SubscribeOptions
+	seq     atomic.Uint64
+	dropped atomic.Uint64
+}
+
+// SubscribeWith subscribes to the values appended from now on, with the given backpressure policy.
+func (log *Memlog[T]) SubscribeWith(stop <-chan struct{}, opts SubscribeOptions) *Subscription[T] {
+	return subscribe(log.NewCursor(), stop, opts, valueOf[T])
+}
+
+// Subscribers returns the current subscriptions, the most lagging first.
+func (log *Memlog[T]) Subscribers() (stats []SubscriberStats) {
+	log.l.Lock()
+	defer log.l.Unlock()
+
+	next := log.nextSeq()
+
+	stats = make([]SubscriberStats, 0, len(log.subscribers))
+	for s := range log.subscribers {
+		seq := s.seq.Load()
+
+		st := SubscriberStats{
+			Name:    s.opts.Name,
+			Policy:  s.opts.Policy,
+			Seq:     seq,
+			Dropped: s.dropped.Load(),
+		}
+		if seq < next {
+			st.Lag = next - seq
+		}
+		stats = append(stats, st)
+	}
+
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Lag > stats[j].Lag })
+	return
+}
+
+func (log *Memlog[T]) register(opts SubscribeOptions, seq uint64) (s *subscriber) {
+	s = &subscriber{opts: opts}
+	s.seq.Store(seq)
+
+	log.l.Lock()
+	log.subscribers[s] = struct{}{}
+	log.l.Unlock()
+	return
+}
+
+func (log *Memlog[T]) unregister(s *subscriber) {
+	log.l.Lock()
+	delete(log.subscribers, s)
+	log.l.Unlock()
+}
+
+// lagging tells if the policy applies to the subscription at seq, given the next sequence number to be appended.
+func (s *subscriber) lagging(next, seq uint64) bool {
+	if s.opts.Policy == Block || s.opts.MaxLag == 0 {
+		return false
+	}
+	return next-seq > s.opts.MaxLag
+}
+
+// fallBehind applies the policy to a lagging subscription at seq.
+func fallBehind[T any](s *subscriber, cursor *Cursor[T], seq uint64) (err error) {
+	if s.opts.Policy == Disconnect {
+		return ErrSlowConsumer
+	}
+
+	next := cursor.skip()
+	s.seq.Store(next)
+
+	dropped := next - seq
+	s.dropped.Add(dropped)
+
+	if s.opts.OnDrop != nil {
+		s.opts.OnDrop(dropped)
+	}
+	return
+}
@@ -0,0 +1,22 @@
+package memlog
+
+import "encoding/json"
+
+// Codec encodes values for persistence.
+type Codec[T any] interface {
+	Encode(v T) ([]byte, error)
+	Decode(data []byte) (T, error)
+}
+
+type JSONCodec[T any] struct{}
+
+var _ Codec[int] = JSONCodec[int]{}
+
+func (JSONCodec[T]) Encode(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec[T]) Decode(data []byte) (v T, err error) {
+	err = json.Unmarshal(data, &v)
+	return
+}
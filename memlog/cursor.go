@@ -0,0 +1,164 @@
+package memlog
+
+import (
+	"context"
+	"errors"
+)
+
+var errStopped = errors.New("stopped")
+
+// Cursor reads entries of a Memlog in batches, without a goroutine.
+// A Cursor is not safe for concurrent use.
+type Cursor[T any] struct {
+	log   *Memlog[T]
+	block *entryBlock[T]
+	pos   int
+	err   error
+}
+
+// NewCursor returns a cursor on the values appended from now on.
+func (log *Memlog[T]) NewCursor() *Cursor[T] {
+	log.l.Lock()
+	defer log.l.Unlock()
+
+	return &Cursor[T]{log: log, block: log.tail, pos: log.tailNextPos}
+}
+
+// CursorFrom returns a cursor starting at the given sequence number.
+// Fails with ErrTruncated if seq is not retained anymore, or ErrFutureSeq if it's after NextSeq.
+func (log *Memlog[T]) CursorFrom(seq uint64) (cursor *Cursor[T], err error) {
+	log.l.Lock()
+	defer log.l.Unlock()
+
+	block, pos, err := log.position(seq)
+	if err != nil {
+		return
+	}
+
+	return &Cursor[T]{log: log, block: block, pos: pos}, nil
+}
+
+// CursorFromStart returns a cursor starting at the oldest retained entry.
+func (log *Memlog[T]) CursorFromStart() *Cursor[T] {
+	log.l.Lock()
+	defer log.l.Unlock()
+
+	return &Cursor[T]{log: log, block: log.blocks[0]}
+}
+
+// Seq returns the sequence number of the next value the cursor will return.
+func (c *Cursor[T]) Seq() uint64 {
+	return c.block.firstSeq + uint64(c.pos)
+}
+
+// Next returns all the values available after the cursor, waiting for at least one.
+// It fails with ErrTruncated if the cursor fell behind the retained entries, ErrClosed once all the entries of
+// a closed Memlog have been read, or with the context's error.
+func (c *Cursor[T]) Next(ctx context.Context) (values []T, err error) {
+	return cursorNext(c, ctx, valueOf[T])
+}
+
+// cursorNext is Cursor.Next, converting the entries with convert.
+func cursorNext[T, U any](c *Cursor[T], ctx context.Context, convert func(e Entry[T]) (U, bool)) (values []U, err error) {
+	block, from, to, err := c.wait(ctx.Done())
+	if err == errStopped {
+		err = ctx.Err()
+	}
+	if err != nil {
+		return
+	}
+
+	c.log.l.Lock()
+	defer c.log.l.Unlock()
+
+	for {
+		for pos := from; pos < to; pos++ {
+			if v, ok := convert(block.entry(pos)); ok {
+				values = append(values, v)
+			}
+		}
+
+		block, from, to, err = c.span()
+		if err != nil || from == to {
+			// return what we have, the error (if any) will be returned again by the next call
+			return values, nil
+		}
+	}
+}
+
+// skip moves the cursor to the last entry of the log, returning its new position.
+func (c *Cursor[T]) skip() uint64 {
+	c.log.l.Lock()
+	defer c.log.l.Unlock()
+
+	block, pos, err := c.log.position(c.log.nextSeq() - 1)
+	if err != nil {
+		block, pos = c.log.tail, c.log.tailNextPos
+	}
+
+	c.block, c.pos = block, pos
+	return c.Seq()
+}
+
+// span returns the entries available in the cursor's block and moves after them. Must be called with the lock held.
+func (c *Cursor[T]) span() (block *entryBlock[T], from, to int, err error) {
+	if c.err != nil {
+		err = c.err
+		return
+	}
+
+	if c.pos == len(c.block.entries) && c.block.next != nil {
+		c.block = c.block.next
+		c.pos = 0
+	}
+
+	if c.block.dropped.Load() {
+		c.err = ErrTruncated
+		err = c.err
+		return
+	}
+
+	block, from, to = c.block, c.pos, len(c.block.entries)
+	if block == c.log.tail {
+		to = c.log.tailNextPos
+
+		if from == to && c.log.closed {
+			c.err = ErrClosed
+			err = c.err
+			return
+		}
+	}
+
+	c.pos = to
+	return
+}
+
+// wait waits for entries after the cursor, and returns those in the cursor's block.
+// Fails with errStopped if stop is closed.
+func (c *Cursor[T]) wait(stop <-chan struct{}) (block *entryBlock[T], from, to int, err error) {
+	for {
+		var changed <-chan struct{}
+		block, from, to, changed, err = c.poll()
+
+		if err != nil || from != to {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-stop:
+			err = errStopped
+			return
+		}
+	}
+}
+
+// poll is span with the lock, also returning the channel to wait on when no entries are available.
+func (c *Cursor[T]) poll() (block *entryBlock[T], from, to int, changed <-chan struct{}, err error) {
+	c.log.l.Lock()
+	defer c.log.l.Unlock()
+
+	block, from, to, err = c.span()
+	changed = c.log.changed
+	return
+}
@@ -0,0 +1,273 @@
+package memlog
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrNotDelivered = errors.New("sequence number not delivered or already acknowledged")
+
+// OffsetStore persists the committed offsets of consumer groups.
+type OffsetStore interface {
+	LoadOffset(group string) (seq uint64, found bool, err error)
+	SaveOffset(group string, seq uint64) error
+}
+
+// OffsetReset is what a group does when its committed offset is not in the Memlog: below FirstSeq (ErrTruncated), or
+// after NextSeq (ErrFutureSeq), like when a non-persistent Memlog was restarted.
+type OffsetReset int
+
+const (
+	// ResetFail makes NewGroup fail with ErrTruncated or ErrFutureSeq.
+	ResetFail OffsetReset = iota
+	// ResetToEarliest resumes at the oldest retained entry.
+	ResetToEarliest
+	// ResetToLatest resumes at the next appended entry.
+	ResetToLatest
+)
+
+type GroupOptions struct {
+	// AckTimeout is the delay after which an unacknowledged entry is delivered again (30s by default)
+	AckTimeout time.Duration
+	// Offsets stores the committed offset, to resume where the group left off
+	Offsets OffsetStore
+	// FromStart starts a group without a committed offset at the oldest retained entry instead of the next one
+	FromStart bool
+	// OffsetReset applies when the committed offset is not in the Memlog
+	OffsetReset OffsetReset
+}
+
+// Group shares the entries of a Memlog between consumers: each entry is returned by Next to only one of them,
+// until it's delivered again if not acknowledged in time.
+// Entries dropped by the retention before being read are skipped: the group continues at the oldest retained entry,
+// and its offset is committed past them.
+type Group[T any] struct {
+	name string
+	opts GroupOptions
+
+	l      sync.Mutex
+	cursor *Cursor[T]
+	// ready are entries read from the cursor, not delivered yet
+	ready []Entry[T]
+	// inflight are the delivered entries waiting for an Ack
+	inflight map[uint64]*delivery[T]
+	acked    map[uint64]bool
+	// lost are the ranges of entries dropped before being read, which are committed like acknowledged ones
+	lost []seqRange
+	// committed is the sequence number of the first entry not acknowledged
+	committed uint64
+}
+
+// seqRange is the range of sequence numbers [from, to)
+type seqRange struct{ from, to uint64 }
+
+type delivery[T any] struct {
+	entry    Entry[T]
+	deadline time.Time
+}
+
+// NewGroup creates a consumer group, starting at its committed offset if any.
+func (log *Memlog[T]) NewGroup(name string, opts GroupOptions) (g *Group[T], err error) {
+	if opts.AckTimeout == 0 {
+		opts.AckTimeout = 30 * time.Second
+	}
+
+	var (
+		offset uint64
+		found  bool
+	)
+
+	if opts.Offsets != nil {
+		offset, found, err = opts.Offsets.LoadOffset(name)
+		if err != nil {
+			return
+		}
+	}
+
+	var cursor *Cursor[T]
+	switch {
+	case found:
+		cursor, err = log.CursorFrom(offset)
+		if err == nil || err != ErrTruncated && err != ErrFutureSeq {
+			break
+		}
+
+		switch opts.OffsetReset {
+		case ResetToEarliest:
+			cursor, err = log.CursorFromStart(), nil
+		case ResetToLatest:
+			cursor, err = log.NewCursor(), nil
+		}
+	case opts.FromStart:
+		cursor = log.CursorFromStart()
+	default:
+		cursor = log.NewCursor()
+	}
+
+	if err != nil {
+		return
+	}
+
+	g = &Group[T]{
+		name:      name,
+		opts:      opts,
+		cursor:    cursor,
+		inflight:  map[uint64]*delivery[T]{},
+		acked:     map[uint64]bool{},
+		committed: cursor.Seq(),
+	}
+	return
+}
+
+// Next returns the next entry to process, waiting for one if needed. The entry must be acknowledged with Ack.
+func (g *Group[T]) Next(ctx context.Context) (e Entry[T], err error) {
+	for {
+		g.l.Lock()
+
+		now := time.Now()
+		var (
+			redeliver    *delivery[T]
+			nextDeadline time.Time
+		)
+		for _, d := range g.inflight {
+			if !d.deadline.After(now) && (redeliver == nil || d.entry.Seq < redeliver.entry.Seq) {
+				redeliver = d
+			}
+			if nextDeadline.IsZero() || d.deadline.Before(nextDeadline) {
+				nextDeadline = d.deadline
+			}
+		}
+
+		if redeliver != nil {
+			redeliver.deadline = now.Add(g.opts.AckTimeout)
+			g.l.Unlock()
+			return redeliver.entry, nil
+		}
+
+		block, from, to, changed, pollErr := g.cursor.poll()
+		if pollErr == ErrTruncated {
+			err = g.skipTruncated()
+			g.l.Unlock()
+			if err != nil {
+				return
+			}
+			continue
+		}
+
+		for pos := from; pos < to; pos++ {
+			g.ready = append(g.ready, block.entry(pos))
+		}
+
+		if len(g.ready) != 0 {
+			e = g.ready[0]
+			g.ready = g.ready[1:]
+			g.inflight[e.Seq] = &delivery[T]{entry: e, deadline: now.Add(g.opts.AckTimeout)}
+			g.l.Unlock()
+			return
+		}
+
+		g.l.Unlock()
+
+		if pollErr != nil {
+			err = pollErr
+			return
+		}
+
+		var (
+			timer   *time.Timer
+			timeout <-chan time.Time
+		)
+		if !nextDeadline.IsZero() {
+			timer = time.NewTimer(nextDeadline.Sub(now))
+			timeout = timer.C
+		}
+
+		select {
+		case <-changed:
+		case <-timeout:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Ack acknowledges the processing of an entry, committing the group's offset when all the previous entries are acknowledged.
+func (g *Group[T]) Ack(seq uint64) (err error) {
+	g.l.Lock()
+	defer g.l.Unlock()
+
+	if _, ok := g.inflight[seq]; !ok {
+		return ErrNotDelivered
+	}
+
+	delete(g.inflight, seq)
+	g.acked[seq] = true
+
+	return g.commit()
+}
+
+// skipTruncated moves the cursor to the oldest retained entry, after the entries it was on were dropped.
+// Must be called with the lock held.
+func (g *Group[T]) skipTruncated() (err error) {
+	lost := seqRange{from: g.cursor.Seq()}
+
+	g.cursor = g.cursor.log.CursorFromStart()
+	lost.to = g.cursor.Seq()
+
+	if lost.to > lost.from {
+		g.lost = append(g.lost, lost)
+	}
+	return g.commit()
+}
+
+// commit moves the committed offset after the acknowledged and lost entries, saving it if it changed.
+// Must be called with the lock held.
+func (g *Group[T]) commit() (err error) {
+	prev := g.committed
+	for {
+		if g.acked[g.committed] {
+			delete(g.acked, g.committed)
+			g.committed++
+		} else if len(g.lost) != 0 && g.lost[0].from == g.committed {
+			g.committed = g.lost[0].to
+			g.lost = g.lost[1:]
+		} else {
+			break
+		}
+	}
+
+	if g.committed != prev && g.opts.Offsets != nil {
+		err = g.opts.Offsets.SaveOffset(g.name, g.committed)
+	}
+	return
+}
+
+// Committed returns the sequence number of the first entry not acknowledged.
+func (g *Group[T]) Committed() uint64 {
+	g.l.Lock()
+	defer g.l.Unlock()
+	return g.committed
+}
+
+// Pending returns the sequence numbers of the delivered entries waiting for an Ack.
+func (g *Group[T]) Pending() (seqs []uint64) {
+	g.l.Lock()
+	defer g.l.Unlock()
+
+	seqs = make([]uint64, 0, len(g.inflight))
+	for seq := range g.inflight {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return
+}
@@ -1,25 +1,74 @@
 package memlog
 
 import (
+	"errors"
 	"reflect"
 	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrFutureSeq = errors.New("sequence number not appended yet")
+	ErrClosed    = errors.New("memlog closed")
 )
 
 type Memlog[T any] struct {
-	l           sync.Mutex
+	l sync.Mutex
+	// blocks are the retained blocks, oldest first
+	blocks      []*entryBlock[T]
 	tail        *entryBlock[T]
 	tailNextPos int
+
+	retention       Retention[T]
+	retainedEntries int
+	retainedBytes   int
+
+	// changed is closed and replaced on each append
+	changed chan struct{}
+	// published is the next sequence number after the last append, readable without the lock
+	published atomic.Uint64
+
+	subscribers map[*subscriber]struct{}
+
+	closed bool
+	done   chan struct{}
+
+	clock func() time.Time
+
+	// wal is the write-ahead log of a persistent Memlog
+	wal *wal[T]
 }
 
 type entryBlock[T any] struct {
-	entries   []entry[T]
-	nextSetCh chan struct{}
-	next      *entryBlock[T]
+	// firstSeq is the sequence number of the first entry
+	firstSeq uint64
+	entries  []entry[T]
+	next     *entryBlock[T]
+
+	// lastAppend is the time of the last append in the block
+	lastAppend time.Time
+	// bytes is the size of the entries (when the retention has a size function)
+	bytes int
+	// dropped is set when the block is dropped by the retention policy
+	dropped atomic.Bool
 }
 
 type entry[T any] struct {
 	value T
-	setCh chan struct{}
+	time  time.Time
+}
+
+// Entry is a value with its sequence number and append time.
+type Entry[T any] struct {
+	Seq   uint64
+	Value T
+	Time  time.Time
+}
+
+func (block *entryBlock[T]) entry(pos int) Entry[T] {
+	e := block.entries[pos]
+	return Entry[T]{Seq: block.firstSeq + uint64(pos), Value: e.value, Time: e.time}
 }
 
 func New[T any]() (log *Memlog[T]) {
@@ -35,86 +84,325 @@ func New[T any]() (log *Memlog[T]) {
 }
 
 func NewWithBlockSize[T any](blockSize int) (log *Memlog[T]) {
+	block := newEntryBlock[T](1, blockSize)
 	log = &Memlog[T]{
-		tail: newEntryBlock[T](blockSize),
+		blocks:      []*entryBlock[T]{block},
+		tail:        block,
+		changed:     make(chan struct{}),
+		subscribers: map[*subscriber]struct{}{},
+		done:        make(chan struct{}),
+		clock:       time.Now,
 	}
+	log.published.Store(1)
 	return
 }
 
-func newEntryBlock[T any](size int) *entryBlock[T] {
-	block := entryBlock[T]{
-		entries:   make([]entry[T], size),
-		nextSetCh: make(chan struct{}),
+func newEntryBlock[T any](firstSeq uint64, size int) *entryBlock[T] {
+	return &entryBlock[T]{
+		firstSeq: firstSeq,
+		entries:  make([]entry[T], size),
 	}
+}
 
-	for i := range block.entries {
-		block.entries[i].setCh = make(chan struct{})
+// Append appends a value, returning its sequence number. Sequence numbers start at 1.
+// Errors can only happen on persistent Memlogs, when writing to the log fails.
+func (log *Memlog[T]) Append(value T) (seq uint64, err error) {
+	log.l.Lock()
+	defer log.l.Unlock()
+
+	if log.closed {
+		err = ErrClosed
+		return
 	}
 
-	return &block
+	seq = log.nextSeq()
+	err = log.appendEntries([]entry[T]{{value, log.now()}})
+	return
 }
 
-func (log *Memlog[T]) Append(value T) {
+// AppendBatch appends values under a single lock, returning the sequence number of the first one.
+func (log *Memlog[T]) AppendBatch(values []T) (firstSeq uint64, err error) {
 	log.l.Lock()
+	defer log.l.Unlock()
+
+	if log.closed {
+		err = ErrClosed
+		return
+	}
+
+	firstSeq = log.nextSeq()
+
+	if len(values) == 0 {
+		return
+	}
+
+	now := log.now()
+
+	entries := make([]entry[T], len(values))
+	for i, value := range values {
+		entries[i] = entry[T]{value, now}
+	}
+
+	err = log.appendEntries(entries)
+	return
+}
 
+// appendEntries appends entries with their append time. Must be called with the lock held.
+func (log *Memlog[T]) appendEntries(entries []entry[T]) (err error) {
+	if log.wal != nil {
+		if err = log.wal.write(log.nextSeq(), entries); err != nil {
+			return
+		}
+	}
+
+	for _, e := range entries {
+		log.appendLocked(e.value, e.time)
+	}
+	log.notify()
+	log.applyRetention()
+	return
+}
+
+// notify wakes up the readers waiting for new entries. Must be called with the lock held.
+func (log *Memlog[T]) notify() {
+	close(log.changed)
+	log.changed = make(chan struct{})
+	log.published.Store(log.nextSeq())
+}
+
+func (log *Memlog[T]) changedCh() <-chan struct{} {
+	log.l.Lock()
+	defer log.l.Unlock()
+	return log.changed
+}
+
+func (log *Memlog[T]) appendLocked(value T, now time.Time) {
 	if log.tailNextPos == len(log.tail.entries) {
-		newBlock := newEntryBlock[T](len(log.tail.entries))
+		newBlock := newEntryBlock[T](log.nextSeq(), len(log.tail.entries))
 
 		log.tail.next = newBlock
-		close(log.tail.nextSetCh)
-
 		log.tail = newBlock
 		log.tailNextPos = 0
+		log.blocks = append(log.blocks, newBlock)
 	}
 
-	log.tail.entries[log.tailNextPos].value = value
-	close(log.tail.entries[log.tailNextPos].setCh)
-
+	log.tail.entries[log.tailNextPos] = entry[T]{value, now}
 	log.tailNextPos++
 
-	log.l.Unlock()
+	log.tail.lastAppend = now
+	log.retainedEntries++
+	if size := log.retention.Size; size != nil {
+		n := size(value)
+		log.tail.bytes += n
+		log.retainedBytes += n
+	}
 }
 
-func (log *Memlog[T]) Subscribe(stop <-chan struct{}) <-chan T {
+// resetAt makes an empty Memlog start at the given sequence number.
+func (log *Memlog[T]) resetAt(seq uint64) {
+	log.tail.firstSeq = seq
+	log.published.Store(seq)
+}
+
+// Close stops the Memlog: appends fail with ErrClosed, and subscriptions end with ErrClosed once they delivered
+// the remaining entries. On a persistent Memlog, it also releases the files.
+func (log *Memlog[T]) Close() (err error) {
 	log.l.Lock()
-	tail := log.tail
-	tailPos := log.tailNextPos
+	if log.closed {
+		log.l.Unlock()
+		return
+	}
+
+	log.closed = true
+	log.notify()
+	close(log.done)
 	log.l.Unlock()
 
-	out := make(chan T) // no buffering needed
+	if log.wal == nil {
+		return
+	}
+	return log.wal.close(log)
+}
+
+// Done returns a channel closed when the Memlog is closed.
+func (log *Memlog[T]) Done() <-chan struct{} {
+	return log.done
+}
+
+func (log *Memlog[T]) nextSeq() uint64 {
+	return log.tail.firstSeq + uint64(log.tailNextPos)
+}
+
+// NextSeq returns the sequence number the next appended value will have.
+func (log *Memlog[T]) NextSeq() uint64 {
+	log.l.Lock()
+	defer log.l.Unlock()
+	return log.nextSeq()
+}
+
+// FirstSeq returns the sequence number of the oldest retained value (NextSeq if there's none).
+func (log *Memlog[T]) FirstSeq() uint64 {
+	log.l.Lock()
+	defer log.l.Unlock()
+	return log.blocks[0].firstSeq
+}
+
+// Get returns the value with the given sequence number, if retained.
+func (log *Memlog[T]) Get(seq uint64) (v T, ok bool) {
+	log.l.Lock()
+	defer log.l.Unlock()
+
+	block, pos, err := log.position(seq)
+	if err != nil || pos == len(block.entries) || seq >= log.nextSeq() {
+		return
+	}
+
+	return block.entries[pos].value, true
+}
+
+// position returns where the entry with the given sequence number is (or will be). Must be called with the lock held.
+func (log *Memlog[T]) position(seq uint64) (block *entryBlock[T], pos int, err error) {
+	first := log.blocks[0].firstSeq
+
+	switch {
+	case seq < first:
+		err = ErrTruncated
+		return
+	case seq > log.nextSeq():
+		err = ErrFutureSeq
+		return
+	}
+
+	blockSize := uint64(len(log.tail.entries))
+	idx := (seq - first) / blockSize
+
+	if idx == uint64(len(log.blocks)) {
+		// next entry, at the start of a block not created yet
+		return log.tail, len(log.tail.entries), nil
+	}
+
+	return log.blocks[idx], int((seq - first) % blockSize), nil
+}
+
+func (log *Memlog[T]) Subscribe(stop <-chan struct{}) <-chan T {
+	return log.NewSubscription(stop).C
+}
+
+// NewSubscription subscribes to the values appended from now on.
+func (log *Memlog[T]) NewSubscription(stop <-chan struct{}) *Subscription[T] {
+	return subscribe(log.NewCursor(), stop, SubscribeOptions{}, valueOf[T])
+}
+
+// SubscribeFilter subscribes to the values appended from now on that match the predicate.
+func (log *Memlog[T]) SubscribeFilter(stop <-chan struct{}, pred func(v T) bool) <-chan T {
+	return subscribe(log.NewCursor(), stop, SubscribeOptions{}, func(e Entry[T]) (T, bool) { return e.Value, pred(e.Value) }).C
+}
+
+// SubscribeMap subscribes to the values appended from now on, transformed by fn. Values for which fn returns false are skipped.
+func SubscribeMap[T, U any](log *Memlog[T], stop <-chan struct{}, fn func(v T) (U, bool)) <-chan U {
+	return subscribe(log.NewCursor(), stop, SubscribeOptions{}, func(e Entry[T]) (U, bool) { return fn(e.Value) }).C
+}
+
+// SubscribeFrom subscribes to the entries from the given sequence number, replaying the retained ones first.
+// The subscription ends with ErrTruncated if seq is not retained anymore, or ErrFutureSeq if it's after NextSeq.
+func (log *Memlog[T]) SubscribeFrom(seq uint64, stop <-chan struct{}) *Subscription[Entry[T]] {
+	cursor, err := log.CursorFrom(seq)
+	if err != nil {
+		return endedSubscription[Entry[T]](err)
+	}
+
+	return subscribe(cursor, stop, SubscribeOptions{}, entryOf[T])
+}
+
+// SubscribeFromStart subscribes to the entries from the oldest retained one.
+func (log *Memlog[T]) SubscribeFromStart(stop <-chan struct{}) *Subscription[Entry[T]] {
+	return subscribe(log.CursorFromStart(), stop, SubscribeOptions{}, entryOf[T])
+}
+
+func valueOf[T any](e Entry[T]) (T, bool) {
+	return e.Value, true
+}
+
+func entryOf[T any](e Entry[T]) (Entry[T], bool) {
+	return e, true
+}
+
+func subscribe[T, U any](cursor *Cursor[T], stop <-chan struct{}, opts SubscribeOptions, convert func(e Entry[T]) (U, bool)) *Subscription[U] {
+	out := make(chan U) // no buffering needed
+
+	log := cursor.log
+	state := log.register(opts, cursor.Seq())
+	sub := &Subscription[U]{C: out, state: state}
 
 	go func() {
 		defer close(out)
+		defer log.unregister(state)
 
+	wait:
 		for {
-			if tailPos == len(tail.entries) {
-				// if at the end of the current block, move to the next one
-				select {
-				case _, _ = <-tail.nextSetCh:
-					tail = tail.next
-					tailPos = 0
-
-				case _, _ = <-stop:
-					return
+			block, from, to, err := cursor.wait(stop)
+			if err != nil {
+				if err != errStopped {
+					sub.err = err
 				}
+				return
 			}
 
-			// consume block
-			select {
-			case _, _ = <-tail.entries[tailPos].setCh:
-				select {
-				case out <- tail.entries[tailPos].value:
-					tailPos++
+			for pos := from; pos < to; pos++ {
+				seq := block.firstSeq + uint64(pos)
+				state.seq.Store(seq)
 
-				case _, _ = <-stop:
+				if block.dropped.Load() {
+					sub.err = ErrTruncated
 					return
 				}
 
-			case _, _ = <-stop:
-				return
+				if state.lagging(log.published.Load(), seq) {
+					if sub.err = fallBehind(state, cursor, seq); sub.err != nil {
+						return
+					}
+					continue wait
+				}
+
+				u, ok := convert(block.entry(pos))
+				if !ok {
+					continue
+				}
+
+				if opts.Policy == Block {
+					select {
+					case out <- u:
+						continue
+					case _, _ = <-stop:
+						return
+					}
+				}
+
+				// watch the lag while waiting for the subscriber
+				for {
+					changed := log.changedCh()
+
+					if state.lagging(log.published.Load(), seq) {
+						if sub.err = fallBehind(state, cursor, seq); sub.err != nil {
+							return
+						}
+						continue wait
+					}
+
+					select {
+					case out <- u:
+					case <-changed:
+						continue
+					case _, _ = <-stop:
+						return
+					}
+					break
+				}
 			}
+
+			state.seq.Store(block.firstSeq + uint64(to))
 		}
 	}()
 
-	return out
+	return sub
 }
@@ -1,9 +1,16 @@
 package memlog
 
 import (
+	"context"
 	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func ExampleMemlog() {
@@ -127,3 +134,868 @@ func benchNSub(b *testing.B, nSub int) {
 
 	wg.Wait()
 }
+
+func TestRetentionTruncates(t *testing.T) {
+	log := NewWithBlockSize[int](2)
+	log.SetRetention(Retention[int]{MaxEntries: 4})
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	sub := log.NewSubscription(stop)
+
+	for n := 0; n < 10; n++ {
+		log.Append(n)
+	}
+
+	count := 0
+	for range sub.C {
+		count++
+	}
+
+	if sub.Err() != ErrTruncated {
+		t.Errorf("expected ErrTruncated, got %v", sub.Err())
+	}
+	if count > 1 {
+		t.Errorf("got %d entries after truncation", count)
+	}
+
+	if log.retainedEntries != 4 {
+		t.Errorf("expected 4 retained entries, got %d", log.retainedEntries)
+	}
+}
+
+func TestRetentionMaxBytes(t *testing.T) {
+	log := NewWithBlockSize[string](2)
+	log.SetRetention(Retention[string]{MaxBytes: 10, Size: func(s string) int { return len(s) }})
+
+	for _, s := range []string{"aaaa", "bbbb", "cccc", "dddd", "eeee"} {
+		log.Append(s)
+	}
+
+	// blocks: [aaaa bbbb] [cccc dddd] [eeee], the first two must be dropped to fit in 10 bytes
+	if len(log.blocks) != 1 {
+		t.Error("only the tail block should remain")
+	}
+	if log.retainedBytes != 4 {
+		t.Errorf("expected 4 retained bytes, got %d", log.retainedBytes)
+	}
+}
+
+func TestNoRetentionReleases(t *testing.T) {
+	log := NewWithBlockSize[int](64)
+
+	heapAlloc := func() uint64 {
+		runtime.GC()
+		stats := runtime.MemStats{}
+		runtime.ReadMemStats(&stats)
+		return stats.HeapAlloc
+	}
+
+	values := make([]int, 1000)
+
+	before := heapAlloc()
+	for n := 0; n < 1000; n++ {
+		log.AppendBatch(values)
+	}
+	after := heapAlloc()
+
+	if first, next := log.FirstSeq(), log.NextSeq(); next-first > 64 {
+		t.Errorf("retaining %d entries", next-first)
+	}
+	if after > before+4<<20 {
+		t.Errorf("heap grew by %d bytes", after-before)
+	}
+
+	// replaying is limited to the last block
+	if _, err := log.CursorFrom(1); err != ErrTruncated {
+		t.Errorf("expected ErrTruncated, got %v", err)
+	}
+
+	// but cursors still read the blocks released after them
+	cursor := log.NewCursor()
+	for n := 0; n < 10; n++ {
+		log.AppendBatch(values)
+	}
+
+	read, err := cursor.Next(context.Background())
+	if err != nil || len(read) != 10_000 {
+		t.Errorf("read %d values: %v", len(read), err)
+	}
+}
+
+func ExampleMemlog_SubscribeFrom() {
+	log := NewWithBlockSize[string](2)
+	log.SetRetention(Retention[string]{MaxEntries: 10})
+
+	for _, s := range []string{"a", "b", "c"} {
+		log.Append(s)
+	}
+
+	stop := make(chan struct{})
+	sub := log.SubscribeFrom(2, stop)
+
+	seq, _ := log.Append("d")
+
+	for e := range sub.C {
+		fmt.Println(e.Seq, e.Value)
+		if e.Seq == seq {
+			break
+		}
+	}
+
+	close(stop)
+
+	v, ok := log.Get(1)
+	fmt.Println(v, ok)
+
+	// Output:
+	// 2 b
+	// 3 c
+	// 4 d
+	// a true
+}
+
+func TestSubscribeFromBounds(t *testing.T) {
+	log := NewWithBlockSize[int](2)
+	log.SetRetention(Retention[int]{MaxEntries: 2})
+
+	for n := 0; n < 6; n++ {
+		log.Append(n)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	if first := log.FirstSeq(); first != 5 {
+		t.Errorf("expected first seq 5, got %d", first)
+	}
+
+	if sub := log.SubscribeFrom(1, stop); sub.Err() != ErrTruncated {
+		t.Errorf("expected ErrTruncated, got %v", sub.Err())
+	}
+	if sub := log.SubscribeFrom(8, stop); sub.Err() != ErrFutureSeq {
+		t.Errorf("expected ErrFutureSeq, got %v", sub.Err())
+	}
+
+	sub := log.SubscribeFromStart(stop)
+	if e := <-sub.C; e.Seq != 5 || e.Value != 4 {
+		t.Errorf("unexpected first entry: %+v", e)
+	}
+
+	if _, ok := log.Get(4); ok {
+		t.Error("seq 4 should not be retained")
+	}
+	if _, ok := log.Get(7); ok {
+		t.Error("seq 7 should not exist")
+	}
+}
+
+func TestPersistent(t *testing.T) {
+	dir := t.TempDir()
+	opts := PersistOptions{BlockSize: 2, SegmentSize: 64}
+
+	log, err := Open[string](dir, JSONCodec[string]{}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for n := 0; n < 10; n++ {
+		if _, err := log.Append(fmt.Sprint("value ", n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := log.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.wal"))
+	if len(segments) < 2 {
+		t.Fatalf("expected segments to rotate, got %v", segments)
+	}
+
+	// simulate a torn write at the end of the last segment
+	f, err := os.OpenFile(segments[len(segments)-1], os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 42, 1, 2})
+	f.Close()
+
+	log, err = Open[string](dir, JSONCodec[string]{}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if seq := log.NextSeq(); seq != 11 {
+		t.Errorf("expected next seq 11, got %d", seq)
+	}
+	if v, _ := log.Get(4); v != "value 3" {
+		t.Errorf("unexpected value at 4: %q", v)
+	}
+
+	if seq, err := log.Append("value 10"); err != nil || seq != 11 {
+		t.Errorf("unexpected append result: %d, %v", seq, err)
+	}
+
+	log.SetRetention(Retention[string]{MaxEntries: 2})
+
+	first := log.FirstSeq()
+	log.Close()
+
+	log, err = Open[string](dir, JSONCodec[string]{}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+
+	if newFirst := log.FirstSeq(); newFirst > first || newFirst == 1 {
+		t.Errorf("expected old segments to be deleted (first seq %d, retained from %d)", newFirst, first)
+	}
+	if v, _ := log.Get(11); v != "value 10" {
+		t.Errorf("unexpected value at 11: %q", v)
+	}
+}
+
+func TestPersistentFailed(t *testing.T) {
+	dir := t.TempDir()
+
+	log, err := Open[string](dir, JSONCodec[string]{}, PersistOptions{SegmentSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+
+	if _, err := log.Append("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the next segment can't be created
+	os.RemoveAll(dir)
+
+	if _, err := log.Append("b"); err == nil {
+		t.Fatal("expected the append to fail")
+	}
+
+	// a failed wal refuses appends
+	os.MkdirAll(dir, 0o755)
+
+	if _, err := log.Append("b"); err == nil {
+		t.Error("expected the append to fail")
+	}
+	if seq := log.NextSeq(); seq != 2 {
+		t.Errorf("expected next seq 2, got %d", seq)
+	}
+}
+
+func ExampleCursor() {
+	log := New[string]()
+
+	cursor := log.NewCursor()
+
+	log.AppendBatch([]string{"a", "b"})
+	log.Append("c")
+
+	values, err := cursor.Next(context.Background())
+	fmt.Println(values, err, cursor.Seq())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+
+	_, err = cursor.Next(ctx)
+	fmt.Println(err)
+
+	// Output:
+	// [a b c] <nil> 4
+	// context deadline exceeded
+}
+
+func TestCursorTruncated(t *testing.T) {
+	log := NewWithBlockSize[int](2)
+	log.SetRetention(Retention[int]{MaxEntries: 2})
+
+	cursor := log.CursorFromStart()
+
+	log.AppendBatch([]int{0, 1, 2, 3, 4})
+
+	if _, err := cursor.Next(context.Background()); err != ErrTruncated {
+		t.Errorf("expected ErrTruncated, got %v", err)
+	}
+}
+
+func BenchmarkCursor1000Sub(b *testing.B) {
+	const nSub = 1000
+
+	log := New[int]()
+
+	wg := sync.WaitGroup{}
+	wg.Add(nSub)
+
+	lastN := b.N - 1
+
+	for subId := 0; subId < nSub; subId++ {
+		cursor := log.NewCursor()
+
+		go func() {
+			defer wg.Done()
+
+			for {
+				values, err := cursor.Next(context.Background())
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				if values[len(values)-1] == lastN {
+					return
+				}
+			}
+		}()
+	}
+
+	for n := 0; n < b.N; n++ {
+		log.Append(n)
+	}
+
+	wg.Wait()
+}
+
+func ExampleSubscribeMap() {
+	log := New[any]()
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	out := SubscribeMap(log, stop, func(v any) (s string, ok bool) {
+		s, ok = v.(string)
+		return
+	})
+
+	log.AppendBatch([]any{1, "a", 2.0, "b"})
+
+	fmt.Println(<-out, <-out)
+
+	// Output:
+	// a b
+}
+
+func TestMerge(t *testing.T) {
+	logs := []*Memlog[int]{New[int](), New[int](), New[int]()}
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	// a shared clock, ticking on each append
+	now := time.Date(2023, 8, 1, 10, 0, 0, 0, time.UTC)
+	for _, log := range logs {
+		log.SetClock(func() time.Time {
+			now = now.Add(time.Second)
+			return now
+		})
+	}
+
+	out := Merge(stop, logs...)
+	even := logs[0].SubscribeFilter(stop, func(n int) bool { return n%2 == 0 })
+
+	for n := 0; n < 30; n++ {
+		logs[n%3].Append(n)
+	}
+
+	lastSeq := make([]uint64, len(logs))
+	for i := 0; i < 30; i++ {
+		e := <-out
+		if e.Value%3 != e.Source {
+			t.Errorf("value %d from source %d", e.Value, e.Source)
+		}
+		if e.Seq != lastSeq[e.Source]+1 {
+			t.Errorf("source %d: seq %d after %d", e.Source, e.Seq, lastSeq[e.Source])
+		}
+		lastSeq[e.Source] = e.Seq
+
+		// ordered by append time across the Memlogs
+		if e.Value != i {
+			t.Errorf("expected %d, got %d", i, e.Value)
+		}
+	}
+
+	for _, expected := range []int{0, 6, 12} {
+		if n := <-even; n != expected {
+			t.Errorf("expected %d, got %d", expected, n)
+		}
+	}
+}
+
+type mapOffsets map[string]uint64
+
+func (m mapOffsets) LoadOffset(group string) (seq uint64, found bool, err error) {
+	seq, found = m[group]
+	return
+}
+
+func (m mapOffsets) SaveOffset(group string, seq uint64) error {
+	m[group] = seq
+	return nil
+}
+
+func TestGroup(t *testing.T) {
+	log := New[int]()
+	offsets := mapOffsets{}
+
+	g, err := log.NewGroup("test", GroupOptions{AckTimeout: 50 * time.Millisecond, Offsets: offsets, FromStart: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log.AppendBatch([]int{0, 1, 2, 3})
+
+	ctx := context.Background()
+
+	seen := map[uint64]bool{}
+	for i := 0; i < 4; i++ {
+		e, err := g.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[e.Seq] {
+			t.Errorf("seq %d delivered twice", e.Seq)
+		}
+		seen[e.Seq] = true
+	}
+
+	g.Ack(1)
+	g.Ack(3)
+	g.Ack(4)
+
+	if offsets["test"] != 2 {
+		t.Errorf("expected offset 2, got %d", offsets["test"])
+	}
+
+	// seq 2 is not acknowledged, so it's delivered again
+	if e, err := g.Next(ctx); err != nil || e.Seq != 2 {
+		t.Errorf("expected redelivery of seq 2, got %+v, %v", e, err)
+	}
+
+	if err := g.Ack(2); err != nil {
+		t.Error(err)
+	}
+	if err := g.Ack(2); err != ErrNotDelivered {
+		t.Errorf("expected ErrNotDelivered, got %v", err)
+	}
+
+	if offsets["test"] != 5 {
+		t.Errorf("expected offset 5, got %d", offsets["test"])
+	}
+
+	// a new group resumes from the stored offset
+	log.Append(4)
+
+	g, err = log.NewGroup("test", GroupOptions{Offsets: offsets})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e, err := g.Next(ctx); err != nil || e.Seq != 5 || e.Value != 4 {
+		t.Errorf("unexpected entry after resume: %+v, %v", e, err)
+	}
+}
+
+func TestGroupOffsetReset(t *testing.T) {
+	log := NewWithBlockSize[int](2)
+	log.SetRetention(Retention[int]{MaxEntries: 2})
+	log.AppendBatch([]int{0, 1, 2, 3, 4, 5})
+
+	first := log.FirstSeq()
+	if first == 1 {
+		t.Fatal("expected entries to be dropped")
+	}
+
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		offset uint64
+		err    error
+	}{
+		{1, ErrTruncated},
+		// as stored before a non-persistent Memlog was restarted
+		{100, ErrFutureSeq},
+	} {
+		offsets := mapOffsets{"test": tc.offset}
+
+		if _, err := log.NewGroup("test", GroupOptions{Offsets: offsets}); err != tc.err {
+			t.Errorf("offset %d: expected %v, got %v", tc.offset, tc.err, err)
+		}
+
+		g, err := log.NewGroup("test", GroupOptions{Offsets: offsets, OffsetReset: ResetToEarliest})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e, err := g.Next(ctx); err != nil || e.Seq != first {
+			t.Errorf("offset %d: expected to resume at %d, got %+v, %v", tc.offset, first, e, err)
+		}
+
+		g, err = log.NewGroup("test", GroupOptions{Offsets: offsets, OffsetReset: ResetToLatest})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c := g.Committed(); c != log.NextSeq() {
+			t.Errorf("offset %d: expected to resume at %d, got %d", tc.offset, log.NextSeq(), c)
+		}
+	}
+}
+
+func TestGroupTruncated(t *testing.T) {
+	log := NewWithBlockSize[int](2)
+	log.SetRetention(Retention[int]{MaxEntries: 2})
+	offsets := mapOffsets{}
+
+	g, err := log.NewGroup("test", GroupOptions{Offsets: offsets})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+
+	log.Append(1)
+
+	// delivered but not acknowledged yet
+	e, err := g.Next(ctx)
+	if err != nil || e.Seq != 1 {
+		t.Fatalf("unexpected entry: %+v, %v", e, err)
+	}
+
+	// the next entries are dropped before being read
+	log.AppendBatch([]int{2, 3, 4, 5, 6, 7})
+	first := log.FirstSeq()
+	if first <= 2 {
+		t.Fatal("expected entries to be dropped")
+	}
+
+	if e, err := g.Next(ctx); err != nil || e.Seq != first {
+		t.Fatalf("expected to continue at %d, got %+v, %v", first, e, err)
+	}
+
+	// the dropped entries are committed once the previous ones are acknowledged
+	if c := g.Committed(); c != 1 {
+		t.Errorf("expected committed 1, got %d", c)
+	}
+	if err := g.Ack(1); err != nil {
+		t.Fatal(err)
+	}
+	if c := g.Committed(); c != first || offsets["test"] != first {
+		t.Errorf("expected committed %d, got %d (saved %d)", first, c, offsets["test"])
+	}
+	if err := g.Ack(first); err != nil {
+		t.Fatal(err)
+	}
+	if c := g.Committed(); c != first+1 {
+		t.Errorf("expected committed %d, got %d", first+1, c)
+	}
+}
+
+func TestBackpressure(t *testing.T) {
+	log := New[int]()
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	var dropped atomic.Uint64
+
+	drop := log.SubscribeWith(stop, SubscribeOptions{Name: "drop", Policy: DropAndNotify, MaxLag: 5,
+		OnDrop: func(n uint64) { dropped.Add(n) }})
+	disconnect := log.SubscribeWith(stop, SubscribeOptions{Name: "disconnect", Policy: Disconnect, MaxLag: 5})
+	log.SubscribeWith(stop, SubscribeOptions{Name: "block"})
+
+	for n := 0; n < 20; n++ {
+		log.Append(n)
+	}
+
+	for range disconnect.C {
+	}
+	if err := disconnect.Err(); err != ErrSlowConsumer {
+		t.Errorf("expected ErrSlowConsumer, got %v", err)
+	}
+
+	// the dropping subscription skips to the end
+	for n := range drop.C {
+		if n == 19 {
+			break
+		}
+	}
+	if drop.Dropped() == 0 || drop.Dropped() != dropped.Load() {
+		t.Errorf("unexpected dropped count: %d (notified %d)", drop.Dropped(), dropped.Load())
+	}
+
+	stats := log.Subscribers()
+	if len(stats) != 2 {
+		t.Fatalf("expected 2 subscribers, got %+v", stats)
+	}
+	if stats[0].Name != "block" || stats[0].Lag != 20 {
+		t.Errorf("unexpected stats: %+v", stats[0])
+	}
+}
+
+func TestClose(t *testing.T) {
+	log := New[int]()
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	sub := log.NewSubscription(stop)
+
+	log.AppendBatch([]int{1, 2, 3})
+	log.Close()
+
+	if _, err := log.Append(4); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+
+	select {
+	case <-log.Done():
+	default:
+		t.Error("Done should be closed")
+	}
+
+	count := 0
+	for range sub.C {
+		count++
+	}
+	if count != 3 || sub.Err() != ErrClosed {
+		t.Errorf("expected 3 entries then ErrClosed, got %d, %v", count, sub.Err())
+	}
+
+	// subscriptions after Close end once the retained entries are delivered
+	count = 0
+	late := log.SubscribeFromStart(stop)
+	for range late.C {
+		count++
+	}
+	if count != 3 || late.Err() != ErrClosed {
+		t.Errorf("expected 3 entries then ErrClosed, got %d, %v", count, late.Err())
+	}
+
+	if _, err := log.NewCursor().Next(context.Background()); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	leader := NewWithBlockSize[string](4)
+	leader.SetRetention(Retention[string]{MaxEntries: 8})
+
+	at := func(minute int) time.Time { return time.Date(2023, 8, 1, 10, minute, 0, 0, time.UTC) }
+
+	minute := 0
+	leader.SetClock(func() time.Time { return at(minute) })
+
+	// entries 1 to 4 are dropped, so the follower starts at 5
+	for ; minute < 10; minute++ {
+		leader.Append(fmt.Sprint("entry ", minute))
+	}
+
+	srv := httptest.NewServer(ReplicationHandler[string](leader, JSONCodec[string]{}))
+	defer srv.Close()
+
+	follower := New[string]()
+	follower.SetRetention(Retention[string]{MaxEntries: 100})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- Follow[string](ctx, srv.URL, JSONCodec[string]{}, follower, FollowOptions{
+			RetryDelay: 10 * time.Millisecond,
+			OnError:    func(error) {},
+		})
+	}()
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	sub := follower.SubscribeFromStart(stop)
+
+	expect := func(seq uint64, value string, minute int) {
+		t.Helper()
+		select {
+		case e := <-sub.C:
+			if e.Seq != seq || e.Value != value || !e.Time.Equal(at(minute)) {
+				t.Errorf("expected %d %q at %v, got %+v", seq, value, at(minute), e)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for %d", seq)
+		}
+	}
+
+	for n := 4; n < 10; n++ {
+		expect(uint64(n+1), fmt.Sprint("entry ", n), n)
+	}
+
+	leader.Append("entry 10")
+	expect(11, "entry 10", 10)
+
+	// the follower reconnects from where it was
+	srv.CloseClientConnections()
+	minute = 11
+	leader.AppendBatch([]string{"entry 11", "entry 12"})
+
+	expect(12, "entry 11", 11)
+	expect(13, "entry 12", 11)
+
+	// the leader's times are kept, so the follower can be queried by time
+	if values := follower.Range(at(9), at(11)); fmt.Sprint(values) != "[entry 9 entry 10]" {
+		t.Errorf("unexpected range: %v", values)
+	}
+
+	since := follower.SubscribeSince(at(10).Add(time.Second), stop)
+	if e := <-since.C; e.Seq != 12 || !e.Time.Equal(at(11)) {
+		t.Errorf("unexpected entry: %+v", e)
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestReplicationCatchUp(t *testing.T) {
+	leader := NewWithBlockSize[int](4)
+	leader.SetRetention(Retention[int]{MaxEntries: 8})
+
+	srv := httptest.NewServer(ReplicationHandler[int](leader, JSONCodec[int]{}))
+	defer srv.Close()
+
+	follower := New[int]()
+	follower.SetRetention(Retention[int]{MaxEntries: 100})
+
+	// follow until the follower has the leader's entries, and return Follow's result
+	follow := func() error {
+		t.Helper()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		done := make(chan error, 1)
+		go func() {
+			done <- Follow[int](ctx, srv.URL, JSONCodec[int]{}, follower, FollowOptions{
+				RetryDelay: 10 * time.Millisecond,
+				OnError:    func(error) {},
+			})
+		}()
+
+		deadline := time.After(5 * time.Second)
+		for follower.NextSeq() != leader.NextSeq() {
+			select {
+			case err := <-done:
+				return err
+			case <-deadline:
+				t.Fatalf("timeout: follower at %d, leader at %d", follower.NextSeq(), leader.NextSeq())
+			case <-time.After(time.Millisecond):
+			}
+		}
+
+		cancel()
+		return <-done
+	}
+
+	for n := 1; n <= 5; n++ {
+		leader.Append(n)
+	}
+	if err := follow(); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	// fallen behind, but within the leader's retention
+	for n := 6; n <= 12; n++ {
+		leader.Append(n)
+	}
+	if err := follow(); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	for seq := uint64(1); seq <= 12; seq++ {
+		if v, ok := follower.Get(seq); !ok || v != int(seq) {
+			t.Errorf("entry %d: %d, %v", seq, v, ok)
+		}
+	}
+
+	// fallen behind the leader's retention
+	for n := 13; n <= 30; n++ {
+		leader.Append(n)
+	}
+	if err := follow(); err != ErrTruncated {
+		t.Errorf("expected ErrTruncated, got %v", err)
+	}
+}
+
+func TestReplicationWithoutRetention(t *testing.T) {
+	// without retention, the leader only keeps its last block
+	leader := NewWithBlockSize[int](4)
+	for n := 1; n <= 10; n++ {
+		leader.Append(n)
+	}
+
+	srv := httptest.NewServer(ReplicationHandler[int](leader, JSONCodec[int]{}))
+	defer srv.Close()
+
+	follower := New[int]()
+	follower.SetRetention(Retention[int]{MaxEntries: 100})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go Follow[int](ctx, srv.URL, JSONCodec[int]{}, follower, FollowOptions{OnError: func(error) {}})
+
+	for follower.NextSeq() != 11 {
+		if ctx.Err() != nil {
+			t.Fatalf("timeout: follower at %d", follower.NextSeq())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, ok := follower.Get(8); ok {
+		t.Error("entries before the leader's last block should not be replicated")
+	}
+	if v, ok := follower.Get(9); !ok || v != 9 {
+		t.Errorf("entry 9: %d, %v", v, ok)
+	}
+}
+
+func TestTimeIndex(t *testing.T) {
+	log := NewWithBlockSize[int](3)
+
+	now := time.Date(2023, 8, 1, 10, 0, 0, 0, time.UTC)
+	log.SetClock(func() time.Time { return now })
+	log.SetRetention(Retention[int]{MaxAge: time.Hour})
+
+	for n := 0; n < 10; n++ {
+		log.Append(n)
+		now = now.Add(time.Minute)
+	}
+
+	at := func(minute int) time.Time { return time.Date(2023, 8, 1, 10, minute, 0, 0, time.UTC) }
+
+	if values := log.Range(at(3), at(6)); fmt.Sprint(values) != "[3 4 5]" {
+		t.Errorf("unexpected range: %v", values)
+	}
+	if values := log.Range(at(8), at(30)); fmt.Sprint(values) != "[8 9]" {
+		t.Errorf("unexpected range: %v", values)
+	}
+	if values := log.Range(at(30), at(40)); len(values) != 0 {
+		t.Errorf("unexpected range: %v", values)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	sub := log.SubscribeSince(at(7).Add(-time.Second), stop)
+	for n := 7; n < 10; n++ {
+		e := <-sub.C
+		if e.Value != n || e.Seq != uint64(n+1) || !e.Time.Equal(at(n)) {
+			t.Errorf("unexpected entry: %+v", e)
+		}
+	}
+
+	log.Append(10)
+	if e := <-sub.C; e.Value != 10 {
+		t.Errorf("unexpected entry: %+v", e)
+	}
+}
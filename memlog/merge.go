@@ -0,0 +1,102 @@
+package memlog
+
+import "reflect"
+
+// MergedEntry is an entry of a merged stream, with the index of its Memlog.
+type MergedEntry[T any] struct {
+	Source int
+	Entry[T]
+}
+
+// Merge subscribes to the values appended from now on to all the given Memlogs, in a single stream ordered by
+// append time (then by Memlog index). The merge doesn't wait for idle Memlogs, so the order is only broken if the
+// clocks of the Memlogs differ (see SetClock). Entries of each Memlog keep their order.
+// A Memlog falling behind its retention is removed from the stream.
+func Merge[T any](stop <-chan struct{}, logs ...*Memlog[T]) <-chan MergedEntry[T] {
+	cursors := make([]*Cursor[T], len(logs))
+	for i, log := range logs {
+		cursors[i] = log.NewCursor()
+	}
+
+	out := make(chan MergedEntry[T])
+
+	go func() {
+		defer close(out)
+
+		// cases are the changed channels of the cursors, and stop as the last one
+		cases := make([]reflect.SelectCase, len(cursors)+1)
+		for i := range cases {
+			cases[i].Dir = reflect.SelectRecv
+		}
+		cases[len(cursors)].Chan = reflect.ValueOf(stop)
+
+		// pending are the entries read from each cursor, not sent yet
+		pending := make([][]Entry[T], len(cursors))
+
+		for {
+			active := 0
+
+			for i, cursor := range cursors {
+				if len(pending[i]) != 0 {
+					active++
+					continue
+				}
+
+				if cursor == nil {
+					cases[i].Chan = reflect.Value{}
+					continue
+				}
+
+				block, from, to, changed, err := cursor.poll()
+				if err != nil {
+					cursors[i] = nil
+					cases[i].Chan = reflect.Value{}
+					continue
+				}
+
+				active++
+				cases[i].Chan = reflect.ValueOf(changed)
+
+				for pos := from; pos < to; pos++ {
+					if block.dropped.Load() {
+						cursors[i] = nil
+						break
+					}
+					pending[i] = append(pending[i], block.entry(pos))
+				}
+			}
+
+			if active == 0 {
+				return
+			}
+
+			// send the oldest pending entry
+			next := -1
+			for i, entries := range pending {
+				if len(entries) != 0 && (next == -1 || entries[0].Time.Before(pending[next][0].Time)) {
+					next = i
+				}
+			}
+
+			if next == -1 {
+				if chosen, _, _ := reflect.Select(cases); chosen == len(cursors) {
+					return
+				}
+				continue
+			}
+
+			e := MergedEntry[T]{Source: next, Entry: pending[next][0]}
+
+			select {
+			case out <- e:
+			case _, _ = <-stop:
+				return
+			}
+
+			pending[next][0] = Entry[T]{}
+			pending[next] = pending[next][1:]
+		}
+	}()
+
+	return out
+}
@@ -0,0 +1,342 @@
+package memlog
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	frameEntries   = 'e'
+	frameHeartbeat = 'h'
+
+	replicationHeartbeat = 10 * time.Second
+	maxFrameSize         = 64 << 20
+)
+
+var ErrSeqMismatch = errors.New("replicated sequence number does not match the follower")
+
+// ReplicationHandler streams the entries of the Memlog, from the sequence number given by the "from" query parameter
+// (or the oldest retained entry), for followers using Follow.
+//
+// The stream is made of frames: 'e', the sequence number of the first entry and the number of entries (uvarints),
+// then for each entry its append time (unix nanoseconds, as a varint difference with the previous entry's) and
+// its value encoded by codec, prefixed by its length (uvarint); or 'h' as a heartbeat.
+// Followers keep the append times of the leader.
+//
+// Followers can only get the entries the leader retains: the leader needs a Retention covering the history new
+// followers need and how far followers may fall behind, as a Memlog without retention only keeps its last block.
+// Followers further behind get ErrTruncated from Follow.
+func ReplicationHandler[T any](memlog *Memlog[T], codec Codec[T]) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var cursor *Cursor[T]
+
+		if from := req.FormValue("from"); from == "" || from == "0" {
+			cursor = memlog.CursorFromStart()
+		} else {
+			seq, err := strconv.ParseUint(from, 10, 64)
+			if err != nil {
+				http.Error(w, "invalid from: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			cursor, err = memlog.CursorFrom(seq)
+			switch err {
+			case nil:
+			case ErrTruncated:
+				http.Error(w, err.Error(), http.StatusGone)
+				return
+			case ErrFutureSeq:
+				http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+				return
+			default:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming unsupported!", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		ctx := req.Context()
+		buf := make([]byte, 0, 4096)
+
+		for {
+			seq := cursor.Seq()
+
+			waitCtx, cancel := context.WithTimeout(ctx, replicationHeartbeat)
+			entries, err := cursorNext(cursor, waitCtx, entryOf[T])
+			cancel()
+
+			buf = buf[:0]
+
+			switch {
+			case err == nil:
+				buf = append(buf, frameEntries)
+				buf = binary.AppendUvarint(buf, seq)
+				buf = binary.AppendUvarint(buf, uint64(len(entries)))
+
+				prevTime := int64(0)
+				for _, e := range entries {
+					data, err := codec.Encode(e.Value)
+					if err != nil {
+						log.Printf("memlog: replication: failed to encode entry: %v", err)
+						return
+					}
+
+					t := e.Time.UnixNano()
+					buf = binary.AppendVarint(buf, t-prevTime)
+					prevTime = t
+
+					buf = binary.AppendUvarint(buf, uint64(len(data)))
+					buf = append(buf, data...)
+				}
+
+			case ctx.Err() != nil:
+				return
+
+			case err == context.DeadlineExceeded:
+				buf = append(buf, frameHeartbeat)
+
+			default:
+				// truncated or closed
+				return
+			}
+
+			if _, err := w.Write(buf); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	})
+}
+
+type FollowOptions struct {
+	// Client is the HTTP client to use (http.DefaultClient by default)
+	Client *http.Client
+	// RetryDelay is the delay before reconnecting (1s by default)
+	RetryDelay time.Duration
+	// OnError is called when the connection fails, before retrying (errors are logged by default)
+	OnError func(err error)
+}
+
+// Follow appends to the follower Memlog the entries streamed by a ReplicationHandler at url, reconnecting from
+// the last received entry on failure, until ctx is done. The follower must be empty or already have been following
+// the same Memlog, and its entries must only be appended by Follow so sequence numbers stay the same.
+// It only returns ctx's error, or an error making the replication impossible (ie ErrTruncated when the leader
+// doesn't retain the entries the follower needs anymore, see ReplicationHandler).
+func Follow[T any](ctx context.Context, url string, codec Codec[T], follower *Memlog[T], opts FollowOptions) (err error) {
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	if opts.RetryDelay == 0 {
+		opts.RetryDelay = time.Second
+	}
+	if opts.OnError == nil {
+		opts.OnError = func(err error) { log.Printf("memlog: follow %s: %v", url, err) }
+	}
+
+	for {
+		err = followOnce(ctx, url, codec, follower, opts.Client)
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if errors.Is(err, ErrTruncated) || errors.Is(err, ErrSeqMismatch) {
+			return
+		}
+
+		if err != nil {
+			opts.OnError(err)
+		}
+
+		select {
+		case <-time.After(opts.RetryDelay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func followOnce[T any](ctx context.Context, baseURL string, codec Codec[T], follower *Memlog[T], client *http.Client) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return
+	}
+
+	if seq, ok := follower.followSeq(); ok {
+		q := u.Query()
+		q.Set("from", strconv.FormatUint(seq, 10))
+		u.RawQuery = q.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusGone:
+		return ErrTruncated
+	default:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, msg)
+	}
+
+	// cancel the request if the leader stops sending heartbeats
+	watchdog := time.AfterFunc(3*replicationHeartbeat, cancel)
+	defer watchdog.Stop()
+
+	in := bufio.NewReader(resp.Body)
+
+	for {
+		var frameType byte
+		frameType, err = in.ReadByte()
+		if err != nil {
+			return
+		}
+
+		watchdog.Reset(3 * replicationHeartbeat)
+
+		switch frameType {
+		case frameHeartbeat:
+			continue
+
+		case frameEntries:
+			seq, entries, err := readEntriesFrame(in, codec)
+			if err != nil {
+				return err
+			}
+
+			if err = follower.appendEntriesAt(seq, entries); err != nil {
+				return err
+			}
+
+		default:
+			return fmt.Errorf("invalid frame type: %q", frameType)
+		}
+	}
+}
+
+func readEntriesFrame[T any](in *bufio.Reader, codec Codec[T]) (seq uint64, entries []entry[T], err error) {
+	seq, err = binary.ReadUvarint(in)
+	if err != nil {
+		return
+	}
+
+	count, err := binary.ReadUvarint(in)
+	if err != nil {
+		return
+	}
+
+	capacity := count
+	if capacity > 1024 {
+		capacity = 1024
+	}
+	entries = make([]entry[T], 0, capacity)
+
+	prevTime := int64(0)
+	for i := uint64(0); i < count; i++ {
+		var delta int64
+		delta, err = binary.ReadVarint(in)
+		if err != nil {
+			return
+		}
+		prevTime += delta
+
+		var size uint64
+		size, err = binary.ReadUvarint(in)
+		if err != nil {
+			return
+		}
+		if size > maxFrameSize {
+			err = fmt.Errorf("entry too large: %d bytes", size)
+			return
+		}
+
+		data := make([]byte, size)
+		if _, err = io.ReadFull(in, data); err != nil {
+			return
+		}
+
+		var v T
+		if v, err = codec.Decode(data); err != nil {
+			return
+		}
+		entries = append(entries, entry[T]{v, time.Unix(0, prevTime)})
+	}
+	return
+}
+
+// followSeq returns the sequence number to follow from, if the Memlog already has entries.
+func (log *Memlog[T]) followSeq() (seq uint64, ok bool) {
+	log.l.Lock()
+	defer log.l.Unlock()
+
+	if log.empty() {
+		return
+	}
+	return log.nextSeq(), true
+}
+
+// empty tells if nothing was ever appended. Must be called with the lock held.
+func (log *Memlog[T]) empty() bool {
+	return log.blocks[0] == log.tail && log.tailNextPos == 0
+}
+
+// appendEntriesAt appends replicated entries, keeping their append time, requiring the first one to have the given
+// sequence number. An empty Memlog is moved to start at seq.
+func (log *Memlog[T]) appendEntriesAt(seq uint64, entries []entry[T]) (err error) {
+	log.l.Lock()
+	defer log.l.Unlock()
+
+	if log.closed {
+		return ErrClosed
+	}
+
+	if log.empty() && seq != log.nextSeq() {
+		if log.wal != nil {
+			if err = log.wal.restartAt(seq); err != nil {
+				return
+			}
+		}
+		log.resetAt(seq)
+	}
+
+	if next := log.nextSeq(); seq != next {
+		return fmt.Errorf("%w: got %d, expected %d", ErrSeqMismatch, seq, next)
+	}
+
+	if len(entries) == 0 {
+		return
+	}
+	return log.appendEntries(entries)
+}
@@ -0,0 +1,89 @@
+package memlog
+
+import "time"
+
+// Retention limits the entries kept by a Memlog. Zero values mean no limit.
+// Whole blocks are dropped, oldest first, and the last block is always kept, so up to a block more
+// than the limits can be retained.
+//
+// Without any limit, the Memlog doesn't retain past entries itself: only the last block is replayable, and older
+// blocks are freed once no subscription or cursor reads them anymore. Persistent Memlogs keep their segments then.
+type Retention[T any] struct {
+	MaxEntries int
+	MaxAge     time.Duration
+	// MaxBytes limits the sum of the entries' sizes, as given by Size.
+	MaxBytes int
+	Size     func(v T) int
+}
+
+// SetRetention sets the retention policy, applied on each append and by Truncate.
+// On persistent Memlogs, the segments of the dropped entries are deleted.
+// Subscriptions on dropped entries end with ErrTruncated.
+func (log *Memlog[T]) SetRetention(retention Retention[T]) {
+	log.l.Lock()
+	defer log.l.Unlock()
+
+	log.retention = retention
+	if retention.Size == nil {
+		log.retainedBytes = 0
+	}
+
+	log.applyRetention()
+}
+
+// Truncate applies the retention policy now, which is only useful to drop entries older than MaxAge without appends.
+func (log *Memlog[T]) Truncate() {
+	log.l.Lock()
+	defer log.l.Unlock()
+
+	log.applyRetention()
+}
+
+func (log *Memlog[T]) applyRetention() {
+	r := log.retention
+	if r.MaxEntries == 0 && r.MaxBytes == 0 && r.MaxAge == 0 {
+		log.releaseBlocks()
+		return
+	}
+
+	now := log.now()
+
+	if log.wal != nil {
+		defer func() { log.wal.dropBefore(log.blocks[0].firstSeq) }()
+	}
+
+	for log.blocks[0] != log.tail {
+		head := log.blocks[0]
+
+		drop := (r.MaxEntries > 0 && log.retainedEntries > r.MaxEntries) ||
+			(r.MaxBytes > 0 && log.retainedBytes > r.MaxBytes) ||
+			(r.MaxAge > 0 && now.Sub(head.lastAppend) > r.MaxAge)
+
+		if !drop {
+			return
+		}
+
+		head.dropped.Store(true)
+
+		log.blocks[0] = nil // don't retain it through the slice's array
+		log.blocks = log.blocks[1:]
+		log.retainedEntries -= len(head.entries)
+		log.retainedBytes -= head.bytes
+	}
+}
+
+// releaseBlocks forgets the blocks before the tail, without marking them dropped: the subscriptions and cursors
+// still reading them follow the blocks' next pointers, and they're garbage collected once read.
+func (log *Memlog[T]) releaseBlocks() {
+	n := len(log.blocks) - 1
+	if n == 0 {
+		return
+	}
+
+	for i, block := range log.blocks[:n] {
+		log.retainedEntries -= len(block.entries)
+		log.retainedBytes -= block.bytes
+		log.blocks[i] = nil // don't retain it through the slice's array
+	}
+	log.blocks = log.blocks[n:]
+}
@@ -0,0 +1,31 @@
+package memlog
+
+import "errors"
+
+var ErrTruncated = errors.New("subscription fell behind the retained entries")
+
+type Subscription[T any] struct {
+	C <-chan T
+
+	err   error
+	state *subscriber
+}
+
+// Err returns why the subscription ended. Only valid once C is closed.
+func (sub *Subscription[T]) Err() error {
+	return sub.err
+}
+
+// Dropped returns the number of entries skipped by the DropAndNotify policy.
+func (sub *Subscription[T]) Dropped() uint64 {
+	if sub.state == nil {
+		return 0
+	}
+	return sub.state.dropped.Load()
+}
+
+func endedSubscription[T any](err error) *Subscription[T] {
+	ch := make(chan T)
+	close(ch)
+	return &Subscription[T]{C: ch, err: err}
+}
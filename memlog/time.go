@@ -0,0 +1,61 @@
+package memlog
+
+import (
+	"sort"
+	"time"
+)
+
+// SetClock sets the function giving the append time of entries (time.Now by default).
+// Times are expected to never go backwards for SubscribeSince and Range to be accurate.
+func (log *Memlog[T]) SetClock(now func() time.Time) {
+	log.l.Lock()
+	defer log.l.Unlock()
+
+	log.clock = now
+}
+
+func (log *Memlog[T]) now() time.Time {
+	return log.clock()
+}
+
+// SubscribeSince subscribes to the entries appended at or after t, replaying the retained ones first.
+func (log *Memlog[T]) SubscribeSince(t time.Time, stop <-chan struct{}) *Subscription[Entry[T]] {
+	log.l.Lock()
+	block, pos, err := log.position(log.searchTime(t))
+	log.l.Unlock()
+
+	if err != nil {
+		return endedSubscription[Entry[T]](err)
+	}
+
+	return subscribe(&Cursor[T]{log: log, block: block, pos: pos}, stop, SubscribeOptions{}, entryOf[T])
+}
+
+// Range returns the retained values appended at or after from, and before to.
+func (log *Memlog[T]) Range(from, to time.Time) (values []T) {
+	log.l.Lock()
+	defer log.l.Unlock()
+
+	first := log.blocks[0].firstSeq
+	start, end := log.searchTime(from)-first, log.searchTime(to)-first
+
+	blockSize := uint64(len(log.tail.entries))
+
+	for i := start; i < end; i++ {
+		values = append(values, log.blocks[i/blockSize].entries[i%blockSize].value)
+	}
+	return
+}
+
+// searchTime returns the sequence number of the first retained entry appended at or after t (or the next one).
+// Must be called with the lock held.
+func (log *Memlog[T]) searchTime(t time.Time) uint64 {
+	blockSize := len(log.tail.entries)
+	count := (len(log.blocks)-1)*blockSize + log.tailNextPos
+
+	idx := sort.Search(count, func(i int) bool {
+		return !log.blocks[i/blockSize].entries[i%blockSize].time.Before(t)
+	})
+
+	return log.blocks[0].firstSeq + uint64(idx)
+}
@@ -0,0 +1,393 @@
+package memlog
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type SyncPolicy int
+
+const (
+	// SyncNone leaves the OS decide when to write to disk.
+	SyncNone SyncPolicy = iota
+	// SyncAlways syncs each append before returning.
+	SyncAlways
+	// SyncPeriodic syncs every SyncInterval.
+	SyncPeriodic
+)
+
+type PersistOptions struct {
+	// BlockSize of the in-memory blocks (0 to guess, like New)
+	BlockSize int
+	// SegmentSize is the size after which a new segment file is started (64MiB by default)
+	SegmentSize int64
+	Sync        SyncPolicy
+	// SyncInterval for SyncPeriodic (1s by default)
+	SyncInterval time.Duration
+}
+
+const (
+	segmentSuffix   = ".wal"
+	recordHeaderLen = 8 // length + CRC
+	maxRecordLen    = 1 << 30
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// wal is the write-ahead log of a persistent Memlog. Records are written in segment files named after the sequence
+// number of their first record. A record is its length (uint32), the CRC-32C of its payload (uint32), and the payload:
+// its sequence number (uint64), its append time (unix nanoseconds, int64) and the encoded value.
+type wal[T any] struct {
+	dir   string
+	codec Codec[T]
+	opts  PersistOptions
+
+	// segments are the first sequence numbers of the segments, oldest first
+	segments []uint64
+	current  *os.File
+	size     int64
+	// err is set when a failed write couldn't be undone, and fails the next writes
+	err error
+
+	stopSync chan struct{}
+	syncDone chan struct{}
+}
+
+// Open opens a persistent Memlog. Values are written to segment files in dir before being appended, and
+// the Memlog is rebuilt from them on Open. Segments are deleted when the retention policy drops all their entries.
+// The Memlog must be closed to release the files.
+func Open[T any](dir string, codec Codec[T], opts PersistOptions) (memlog *Memlog[T], err error) {
+	if opts.SegmentSize == 0 {
+		opts.SegmentSize = 64 << 20
+	}
+	if opts.SyncInterval == 0 {
+		opts.SyncInterval = time.Second
+	}
+
+	if err = os.MkdirAll(dir, 0o755); err != nil {
+		return
+	}
+
+	w := &wal[T]{dir: dir, codec: codec, opts: opts}
+
+	if opts.BlockSize == 0 {
+		memlog = New[T]()
+	} else {
+		memlog = NewWithBlockSize[T](opts.BlockSize)
+	}
+
+	if err = w.load(memlog); err != nil {
+		return
+	}
+	memlog.notify()
+
+	current := memlog.nextSeq()
+	if n := len(w.segments); n != 0 {
+		current = w.segments[n-1]
+	}
+
+	if err = w.openSegment(current); err != nil {
+		return
+	}
+
+	if opts.Sync == SyncPeriodic {
+		w.stopSync = make(chan struct{})
+		w.syncDone = make(chan struct{})
+		go w.syncLoop(memlog)
+	}
+
+	memlog.wal = w
+	return
+}
+
+func (w *wal[T]) segmentPath(firstSeq uint64) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%020d%s", firstSeq, segmentSuffix))
+}
+
+func (w *wal[T]) listSegments() (segments []uint64, err error) {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+
+		seq, parseErr := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if parseErr != nil {
+			continue
+		}
+		segments = append(segments, seq)
+	}
+
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return
+}
+
+// load replays the segments into the memlog. A partially written record at the end of the last segment
+// (ie after a crash) is truncated.
+func (w *wal[T]) load(memlog *Memlog[T]) (err error) {
+	w.segments, err = w.listSegments()
+	if err != nil || len(w.segments) == 0 {
+		return
+	}
+
+	memlog.resetAt(w.segments[0])
+
+	for i, firstSeq := range w.segments {
+		last := i == len(w.segments)-1
+
+		if firstSeq != memlog.nextSeq() {
+			return fmt.Errorf("segment %d: expected to start at %d", firstSeq, memlog.nextSeq())
+		}
+
+		var validSize int64
+		validSize, err = w.loadSegment(memlog, firstSeq)
+
+		if err != nil && last {
+			log.Printf("memlog: %s: truncating segment %d at %d: %v", w.dir, firstSeq, validSize, err)
+			err = os.Truncate(w.segmentPath(firstSeq), validSize)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (w *wal[T]) loadSegment(memlog *Memlog[T], firstSeq uint64) (validSize int64, err error) {
+	f, err := os.Open(w.segmentPath(firstSeq))
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	in := newCountingReader(f)
+	header := make([]byte, recordHeaderLen)
+
+	for {
+		validSize = in.n
+
+		_, err = io.ReadFull(in, header)
+		if err == io.EOF {
+			return validSize, nil
+		} else if err != nil {
+			return
+		}
+
+		length := binary.BigEndian.Uint32(header)
+		if length < 16 || length > maxRecordLen {
+			err = fmt.Errorf("invalid record length: %d", length)
+			return
+		}
+
+		payload := make([]byte, length)
+		if _, err = io.ReadFull(in, payload); err != nil {
+			return
+		}
+
+		if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(header[4:]) {
+			err = errors.New("CRC mismatch")
+			return
+		}
+
+		seq := binary.BigEndian.Uint64(payload)
+		if seq != memlog.nextSeq() {
+			err = fmt.Errorf("record %d: expected sequence number %d", seq, memlog.nextSeq())
+			return
+		}
+
+		appendTime := time.Unix(0, int64(binary.BigEndian.Uint64(payload[8:])))
+
+		var v T
+		if v, err = w.codec.Decode(payload[16:]); err != nil {
+			err = fmt.Errorf("record %d: %w", seq, err)
+			return
+		}
+
+		memlog.appendLocked(v, appendTime)
+	}
+}
+
+// openSegment opens the segment starting at firstSeq for appending, creating it if needed.
+func (w *wal[T]) openSegment(firstSeq uint64) (err error) {
+	f, err := os.OpenFile(w.segmentPath(firstSeq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return
+	}
+
+	if n := len(w.segments); n == 0 || w.segments[n-1] != firstSeq {
+		w.segments = append(w.segments, firstSeq)
+	}
+
+	w.current = f
+	w.size = stat.Size()
+	return
+}
+
+// write appends entries starting at seq. Must be called with the memlog lock held.
+func (w *wal[T]) write(seq uint64, entries []entry[T]) (err error) {
+	if w.err != nil {
+		return w.err
+	}
+
+	if w.size >= w.opts.SegmentSize {
+		if err = w.rotate(seq); err != nil {
+			w.err = fmt.Errorf("segment rotation failed: %w", err)
+			return
+		}
+	}
+
+	var buf []byte
+
+	for i, e := range entries {
+		var data []byte
+		if data, err = w.codec.Encode(e.value); err != nil {
+			return
+		}
+
+		start := len(buf)
+		buf = append(buf, make([]byte, recordHeaderLen)...)
+		buf = binary.BigEndian.AppendUint64(buf, seq+uint64(i))
+		buf = binary.BigEndian.AppendUint64(buf, uint64(e.time.UnixNano()))
+		buf = append(buf, data...)
+
+		payload := buf[start+recordHeaderLen:]
+		binary.BigEndian.PutUint32(buf[start:], uint32(len(payload)))
+		binary.BigEndian.PutUint32(buf[start+4:], crc32.Checksum(payload, crcTable))
+	}
+
+	n, err := w.current.Write(buf)
+	if err == nil && w.opts.Sync == SyncAlways {
+		err = w.current.Sync()
+	}
+
+	if err != nil {
+		if n != 0 {
+			w.undo(err)
+		}
+		return
+	}
+
+	w.size += int64(n)
+	return
+}
+
+// undo truncates what a failed write left in the current segment, as the entries are not appended.
+// If that fails too, the wal is failed.
+func (w *wal[T]) undo(writeErr error) {
+	if err := w.current.Truncate(w.size); err != nil {
+		w.err = fmt.Errorf("failed to undo a failed write (%v): %w", writeErr, err)
+		log.Printf("memlog: %s: %v", w.dir, w.err)
+	}
+}
+
+func (w *wal[T]) rotate(nextSeq uint64) (err error) {
+	if err = w.current.Sync(); err != nil {
+		return
+	}
+	if err = w.current.Close(); err != nil {
+		return
+	}
+
+	return w.openSegment(nextSeq)
+}
+
+// restartAt replaces the only segment, which must be empty, by one starting at seq. Must be called with the memlog lock held.
+func (w *wal[T]) restartAt(seq uint64) (err error) {
+	if err = w.current.Close(); err != nil {
+		return
+	}
+	if err = os.Remove(w.segmentPath(w.segments[0])); err != nil {
+		return
+	}
+
+	w.segments = nil
+	return w.openSegment(seq)
+}
+
+// dropBefore deletes the segments having only entries before firstSeq. Must be called with the memlog lock held.
+func (w *wal[T]) dropBefore(firstSeq uint64) {
+	for len(w.segments) > 1 && w.segments[1] <= firstSeq {
+		if err := os.Remove(w.segmentPath(w.segments[0])); err != nil && !os.IsNotExist(err) {
+			log.Printf("memlog: %s: failed to remove segment %d: %v", w.dir, w.segments[0], err)
+			return
+		}
+		w.segments = w.segments[1:]
+	}
+}
+
+func (w *wal[T]) syncLoop(memlog *Memlog[T]) {
+	defer close(w.syncDone)
+
+	ticker := time.NewTicker(w.opts.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stopSync:
+			return
+
+		case <-ticker.C:
+			memlog.l.Lock()
+			err := w.current.Sync()
+			memlog.l.Unlock()
+
+			if err != nil {
+				log.Printf("memlog: %s: sync failed: %v", w.dir, err)
+			}
+		}
+	}
+}
+
+// close syncs and closes the current segment. Must be called without the memlog lock held.
+func (w *wal[T]) close(memlog *Memlog[T]) (err error) {
+	if w.stopSync != nil {
+		close(w.stopSync)
+		<-w.syncDone
+	}
+
+	memlog.l.Lock()
+	defer memlog.l.Unlock()
+
+	if err = w.current.Sync(); err != nil {
+		w.current.Close()
+		return
+	}
+	return w.current.Close()
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func newCountingReader(r io.Reader) *countingReader {
+	return &countingReader{r: r}
+}
+
+func (r *countingReader) Read(ba []byte) (n int, err error) {
+	n, err = r.r.Read(ba)
+	r.n += int64(n)
+	return
+}
@@ -0,0 +1,70 @@
+package memlog
+
+import (
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestPersistentWriteError(t *testing.T) {
+	dir := t.TempDir()
+
+	log, err := Open[string](dir, JSONCodec[string]{}, PersistOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := log.Append("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	size := log.wal.size
+
+	// limit the file size so the next write is torn
+	signal.Ignore(syscall.SIGXFSZ)
+	defer signal.Reset(syscall.SIGXFSZ)
+
+	limit := syscall.Rlimit{}
+	if err := syscall.Getrlimit(syscall.RLIMIT_FSIZE, &limit); err != nil {
+		t.Fatal(err)
+	}
+	reduced := limit
+	reduced.Cur = uint64(size) + 10
+	if err := syscall.Setrlimit(syscall.RLIMIT_FSIZE, &reduced); err != nil {
+		t.Skip("can't limit the file size:", err)
+	}
+
+	_, err = log.Append(strings.Repeat("b", 100))
+
+	if err := syscall.Setrlimit(syscall.RLIMIT_FSIZE, &limit); err != nil {
+		t.Fatal(err)
+	}
+
+	if err == nil {
+		t.Fatal("expected the append to fail")
+	}
+
+	if stat, err := os.Stat(log.wal.segmentPath(1)); err != nil || stat.Size() != size {
+		t.Errorf("segment not truncated back to %d bytes: %v, %v", size, stat.Size(), err)
+	}
+	if seq := log.NextSeq(); seq != 2 {
+		t.Errorf("expected next seq 2, got %d", seq)
+	}
+
+	if seq, err := log.Append("c"); err != nil || seq != 2 {
+		t.Errorf("unexpected append result: %d, %v", seq, err)
+	}
+	log.Close()
+
+	log, err = Open[string](dir, JSONCodec[string]{}, PersistOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+
+	if v, _ := log.Get(2); v != "c" {
+		t.Errorf("unexpected value at 2: %q", v)
+	}
+}
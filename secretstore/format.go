@@ -0,0 +1,408 @@
+package secretstore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// The store file is the magic, the format version, then records, and the SHA-256 of all of that.
+// A record is its type (a byte), the length of its payload (uvarint) and the payload, a JSON object.
+// The header record comes first, followed by a record per key slot and a record per secret of the vault.
+//
+// Older formats, only read:
+//   - v1: the magic, the version, the salt, then key slots: a kind byte, then for legacy slots the hash of the
+//     passphrase key and the AES-CFB encrypted master key, for AEAD slots a random nonce and the AES-GCM sealed
+//     master key.
+//   - v0: the salt followed by legacy slots, without their kind byte.
+const (
+	storeMagic   = "\x00SSTORE\x00"
+	storeVersion = 2
+
+	recordHeader = 'H'
+	recordSlot   = 'K'
+	recordSecret = 'S'
+
+	maxStoreSize = 64 << 20
+)
+
+var ErrCorrupted = errors.New("store file is corrupted or truncated")
+
+type headerRecord struct {
+	Salt []byte `json:"salt"`
+	// KDF are the parameters of new slots
+	KDF     KDFParams `json:"kdf"`
+	DataKey []byte    `json:"dataKey,omitempty"`
+}
+
+type slotRecord struct {
+	Kind      string     `json:"kind"`
+	Label     string     `json:"label,omitempty"`
+	KDF       *KDFParams `json:"kdf,omitempty"`
+	Salt      []byte     `json:"salt,omitempty"`
+	Hash      []byte     `json:"hash,omitempty"`
+	Recipient []byte     `json:"recipient,omitempty"`
+	Key       []byte     `json:"key"`
+	Created   *time.Time `json:"created,omitempty"`
+	LastUsed  *time.Time `json:"lastUsed,omitempty"`
+}
+
+var slotKinds = map[byte]string{
+	slotLegacy:     "legacy",
+	slotPassphrase: "passphrase",
+	slotRawKey:     "key",
+	slotX25519:     "x25519",
+	slotSSH:        "ssh-ed25519",
+}
+
+func (s *Store) ReadFrom(in io.Reader) (n int64, err error) {
+	memzero(s.key[:])
+	memzero(s.dataKey[:])
+	s.unlocked = false
+
+	defer func() {
+		if err != nil {
+			log.Output(2, fmt.Sprintf("failed after %d bytes", n))
+		}
+	}()
+
+	data, err := io.ReadAll(io.LimitReader(in, maxStoreSize+1))
+	n = int64(len(data))
+	if err != nil {
+		return
+	}
+
+	if len(data) > maxStoreSize {
+		err = fmt.Errorf("store file too large")
+		return
+	}
+
+	if !bytes.HasPrefix(data, []byte(storeMagic)) {
+		s.version = 0
+		err = s.readLegacy(bytes.NewReader(data))
+		return
+	}
+
+	if len(data) < len(storeMagic)+1 {
+		err = ErrCorrupted
+		return
+	}
+
+	switch version := data[len(storeMagic)]; version {
+	case 1:
+		s.version = version
+		err = s.readLegacy(bytes.NewReader(data[len(storeMagic)+1:]))
+	case storeVersion:
+		s.version = version
+		err = s.readRecords(data)
+	default:
+		err = ErrUnsupported
+	}
+	return
+}
+
+func (s *Store) readRecords(data []byte) (err error) {
+	if len(data) < len(storeMagic)+1+sha256.Size {
+		return ErrCorrupted
+	}
+
+	content, sum := data[:len(data)-sha256.Size], data[len(data)-sha256.Size:]
+	if expected := sha256.Sum256(content); !bytes.Equal(sum, expected[:]) {
+		return ErrCorrupted
+	}
+
+	in := bytes.NewReader(content[len(storeMagic)+1:])
+
+	s.keys = make([]keyEntry, 0)
+	s.secrets = map[string]*secretEntry{}
+	headerRead := false
+
+	for in.Len() != 0 {
+		var recordType byte
+		var payload []byte
+
+		recordType, payload, err = readRecord(in)
+		if err != nil {
+			return
+		}
+
+		if !headerRead && recordType != recordHeader {
+			return fmt.Errorf("%w: missing header", ErrCorrupted)
+		}
+
+		switch recordType {
+		case recordHeader:
+			if headerRead {
+				return fmt.Errorf("%w: duplicate header", ErrCorrupted)
+			}
+			headerRead = true
+
+			header := headerRecord{}
+			if err = json.Unmarshal(payload, &header); err != nil {
+				return
+			}
+			if len(header.Salt) != len(s.salt) {
+				return fmt.Errorf("%w: invalid salt", ErrCorrupted)
+			}
+			if err = header.KDF.validate(); err != nil {
+				return
+			}
+
+			copy(s.salt[:], header.Salt)
+			s.kdf = header.KDF
+			s.encDataKey = header.DataKey
+
+		case recordSlot:
+			slot := slotRecord{}
+			if err = json.Unmarshal(payload, &slot); err != nil {
+				return
+			}
+
+			var k keyEntry
+			if k, err = s.slotFromRecord(slot); err != nil {
+				return
+			}
+			if k.label == "" {
+				k.label = s.newLabel()
+			} else if s.slotIndex(k.label) != -1 {
+				return fmt.Errorf("%w: duplicate key label %q", ErrCorrupted, k.label)
+			}
+			s.keys = append(s.keys, k)
+
+		case recordSecret:
+			e := &secretEntry{}
+			if err = json.Unmarshal(payload, e); err != nil {
+				return
+			}
+			if e.Name == "" || len(e.Versions) == 0 || s.secrets[e.Name] != nil {
+				return fmt.Errorf("%w: invalid secret record", ErrCorrupted)
+			}
+			s.secrets[e.Name] = e
+
+		default:
+			return fmt.Errorf("%w: unknown record type %q", ErrUnsupported, recordType)
+		}
+	}
+
+	if !headerRead {
+		return fmt.Errorf("%w: missing header", ErrCorrupted)
+	}
+	return
+}
+
+func (s *Store) slotFromRecord(slot slotRecord) (k keyEntry, err error) {
+	kind, ok := byte(0), false
+	for kk, name := range slotKinds {
+		if name == slot.Kind {
+			kind, ok = kk, true
+			break
+		}
+	}
+	if !ok {
+		err = fmt.Errorf("%w: unknown key slot kind %q", ErrUnsupported, slot.Kind)
+		return
+	}
+
+	k = keyEntry{kind: kind, label: slot.Label, salt: slot.Salt, encKey: slot.Key, recipient: slot.Recipient}
+
+	if slot.Created != nil {
+		k.created = *slot.Created
+	}
+	if slot.LastUsed != nil {
+		k.lastUsed = *slot.LastUsed
+	}
+
+	if k.usesKDF() {
+		if slot.KDF == nil {
+			err = fmt.Errorf("%w: key slot without KDF parameters", ErrCorrupted)
+			return
+		}
+		if err = slot.KDF.validate(); err != nil {
+			return
+		}
+		k.kdf = *slot.KDF
+	}
+
+	switch kind {
+	case slotLegacy:
+		if len(slot.Hash) != len(k.hash) || len(slot.Key) != len(s.key) {
+			err = fmt.Errorf("%w: invalid legacy key slot", ErrCorrupted)
+			return
+		}
+		copy(k.hash[:], slot.Hash)
+
+	case slotPassphrase:
+		if len(slot.Key) != wrappedKeyLen || len(slot.Salt) == 0 {
+			err = fmt.Errorf("%w: invalid passphrase key slot", ErrCorrupted)
+			return
+		}
+
+	case slotRawKey:
+		if len(slot.Key) != wrappedKeyLen || len(slot.Salt) == 0 {
+			err = fmt.Errorf("%w: invalid raw key slot", ErrCorrupted)
+			return
+		}
+
+	case slotX25519, slotSSH:
+		if len(slot.Key) != wrappedKeyLen || len(slot.Salt) != 32 || len(slot.Recipient) == 0 ||
+			kind == slotX25519 && len(slot.Recipient) != 32 {
+			err = fmt.Errorf("%w: invalid %s key slot", ErrCorrupted, slot.Kind)
+			return
+		}
+	}
+	return
+}
+
+func readRecord(in *bytes.Reader) (recordType byte, payload []byte, err error) {
+	recordType, err = in.ReadByte()
+	if err != nil {
+		return
+	}
+
+	size, err := binary.ReadUvarint(in)
+	if err != nil || size > uint64(in.Len()) {
+		err = ErrCorrupted
+		return
+	}
+
+	payload = make([]byte, size)
+	_, err = io.ReadFull(in, payload)
+	return
+}
+
+func appendRecord(buf []byte, recordType byte, v any) (_ []byte, err error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+
+	buf = append(buf, recordType)
+	buf = binary.AppendUvarint(buf, uint64(len(payload)))
+	return append(buf, payload...), nil
+}
+
+// readLegacy reads the v0 and v1 formats, after the magic and version.
+func (s *Store) readLegacy(in *bytes.Reader) (err error) {
+	readFull := func(ba []byte) {
+		_, err = io.ReadFull(in, ba)
+	}
+
+	readFull(s.salt[:])
+	if err != nil {
+		return
+	}
+
+	s.kdf = DefaultKDFParams
+	s.encDataKey = nil
+	s.secrets = nil
+
+	// read the (encrypted) keys
+	s.keys = make([]keyEntry, 0)
+	for {
+		k := keyEntry{kind: slotLegacy, salt: bytes.Clone(s.salt[:]), kdf: legacyKDFParams}
+
+		if s.version != 0 {
+			var kind byte
+			kind, err = in.ReadByte()
+			if err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				return
+			}
+			k.kind = kind
+		}
+
+		switch k.kind {
+		case slotLegacy:
+			readFull(k.hash[:])
+			if err == io.EOF && s.version == 0 {
+				// end of the legacy slots
+				err = nil
+				return
+			} else if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			if err != nil {
+				return
+			}
+
+			k.encKey = make([]byte, 32)
+
+		case slotPassphrase:
+			k.encKey = make([]byte, wrappedKeyLen)
+
+		default:
+			err = fmt.Errorf("unknown key slot kind: %d", k.kind)
+			return
+		}
+
+		readFull(k.encKey)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return
+		}
+
+		k.label = s.newLabel()
+		s.keys = append(s.keys, k)
+	}
+}
+
+func (s *Store) WriteTo(out io.Writer) (n int64, err error) {
+	buf := append([]byte(storeMagic), storeVersion)
+
+	buf, err = appendRecord(buf, recordHeader, headerRecord{Salt: s.salt[:], KDF: s.kdf, DataKey: s.encDataKey})
+	if err != nil {
+		return
+	}
+
+	for _, k := range s.keys {
+		k := k
+		slot := slotRecord{
+			Kind:      slotKinds[k.kind],
+			Label:     k.label,
+			Salt:      k.salt,
+			Recipient: k.recipient,
+			Key:       k.encKey,
+		}
+		if k.usesKDF() {
+			slot.KDF = &k.kdf
+		}
+		if k.kind == slotLegacy {
+			slot.Hash = k.hash[:]
+		}
+		if !k.created.IsZero() {
+			slot.Created = &k.created
+		}
+		if !k.lastUsed.IsZero() {
+			slot.LastUsed = &k.lastUsed
+		}
+
+		buf, err = appendRecord(buf, recordSlot, slot)
+		if err != nil {
+			return
+		}
+	}
+
+	for _, name := range s.secretNames() {
+		buf, err = appendRecord(buf, recordSecret, s.secrets[name])
+		if err != nil {
+			return
+		}
+	}
+
+	sum := sha256.Sum256(buf)
+	buf = append(buf, sum[:]...)
+
+	nw, err := out.Write(buf)
+	n = int64(nw)
+	return
+}
@@ -0,0 +1,250 @@
+package secretstore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func writeStore(t *testing.T, s *Store) []byte {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	if _, err := s.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func readStore(data []byte) (s *Store, err error) {
+	s = New()
+	_, err = s.ReadFrom(bytes.NewReader(data))
+	return
+}
+
+// buildStore returns a v2 store file made of the given records.
+func buildStore(t *testing.T, records ...[]byte) []byte {
+	t.Helper()
+
+	buf := append([]byte(storeMagic), storeVersion)
+	for _, r := range records {
+		buf = append(buf, r...)
+	}
+
+	sum := sha256.Sum256(buf)
+	return append(buf, sum[:]...)
+}
+
+func record(t *testing.T, recordType byte, v any) []byte {
+	t.Helper()
+
+	r, err := appendRecord(nil, recordType, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestStoreFormat(t *testing.T) {
+	s := newTestStore(t)
+	if err := s.AddLabeledKey("second", []byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.PutSecret("api-token", []byte("t0ken")); err != nil {
+		t.Fatal(err)
+	}
+
+	data := writeStore(t, s)
+	if !bytes.HasPrefix(data, append([]byte(storeMagic), storeVersion, recordHeader)) {
+		t.Errorf("unexpected file start: %q", data[:len(storeMagic)+2])
+	}
+
+	s2, err := readStore(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+
+	if s2.Unlocked() || s2.NeedsUpgrade() || s2.KDFParams() != testKDFParams {
+		t.Errorf("unexpected state: unlocked=%v needsUpgrade=%v kdf=%+v", s2.Unlocked(), s2.NeedsUpgrade(), s2.KDFParams())
+	}
+
+	keys := s2.Keys()
+	if len(keys) != 2 || keys[0].Label != "default" || keys[1].Label != "second" ||
+		keys[1].Kind != "passphrase" || keys[1].KDF != testKDFParams || keys[1].Created.IsZero() {
+		t.Errorf("unexpected keys: %+v", keys)
+	}
+
+	if s2.Unlock([]byte("wrong")) {
+		t.Error("unlocked with a wrong passphrase")
+	}
+	if !s2.Unlock([]byte("second")) {
+		t.Fatal("failed to unlock")
+	}
+
+	if v, err := s2.GetSecret("api-token"); err != nil || string(v) != "t0ken" {
+		t.Errorf("got %q, %v", v, err)
+	}
+}
+
+func TestStoreChecksum(t *testing.T) {
+	data := writeStore(t, newTestStore(t))
+
+	for _, pos := range []int{len(storeMagic) + 5, len(data) / 2, len(data) - 1} {
+		corrupted := bytes.Clone(data)
+		corrupted[pos] ^= 1
+
+		if _, err := readStore(corrupted); err != ErrCorrupted {
+			t.Errorf("byte %d modified: expected ErrCorrupted, got %v", pos, err)
+		}
+	}
+
+	for _, size := range []int{len(storeMagic) + 1, len(storeMagic) + 10, len(data) - 1} {
+		if _, err := readStore(data[:size]); err != ErrCorrupted {
+			t.Errorf("truncated at %d: expected ErrCorrupted, got %v", size, err)
+		}
+	}
+}
+
+func TestStoreRecords(t *testing.T) {
+	s := newTestStore(t)
+
+	header := record(t, recordHeader, headerRecord{Salt: s.salt[:], KDF: testKDFParams})
+	slot := record(t, recordSlot, slotRecord{Kind: "passphrase", Label: "default", KDF: &testKDFParams,
+		Salt: s.keys[0].salt, Key: s.keys[0].encKey})
+
+	if s2, err := readStore(buildStore(t, header, slot)); err != nil {
+		t.Errorf("valid store: %v", err)
+	} else if !s2.Unlock([]byte("test")) {
+		t.Error("failed to unlock")
+	}
+
+	for _, tc := range []struct {
+		name    string
+		records [][]byte
+		err     error
+		msg     string
+	}{
+		{"no records", nil, ErrCorrupted, "missing header"},
+		{"slot first", [][]byte{slot, header}, ErrCorrupted, "missing header"},
+		{"duplicate header", [][]byte{header, header, slot}, ErrCorrupted, "duplicate header"},
+		{"duplicate label", [][]byte{header, slot, slot}, ErrCorrupted, "duplicate key label"},
+		{"unknown record", [][]byte{header, slot, {'X', 2, '{', '}'}}, ErrUnsupported, "unknown record type"},
+		{"record overflow", [][]byte{header, {recordSlot, 100, '{', '}'}}, ErrCorrupted, ""},
+		{"unknown slot kind", [][]byte{header, record(t, recordSlot, slotRecord{Kind: "rot13"})}, ErrUnsupported, "rot13"},
+		{"invalid slot", [][]byte{header, record(t, recordSlot, slotRecord{Kind: "passphrase", KDF: &testKDFParams})},
+			ErrCorrupted, "invalid passphrase key slot"},
+	} {
+		_, err := readStore(buildStore(t, tc.records...))
+		if !errors.Is(err, tc.err) || !strings.Contains(err.Error(), tc.msg) {
+			t.Errorf("%s: expected %v (%s), got %v", tc.name, tc.err, tc.msg, err)
+		}
+	}
+
+	version := buildStore(t, header, slot)
+	version[len(storeMagic)] = storeVersion + 1
+	if _, err := readStore(version); err != ErrUnsupported {
+		t.Errorf("expected ErrUnsupported, got %v", err)
+	}
+}
+
+func TestStoreSizeLimit(t *testing.T) {
+	in := io.MultiReader(strings.NewReader(storeMagic), io.LimitReader(zeroReader{}, maxStoreSize))
+
+	s := New()
+	n, err := s.ReadFrom(in)
+	if err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("expected the store to be too large, got %v", err)
+	}
+	if n > maxStoreSize+1 {
+		t.Errorf("read %d bytes", n)
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(ba []byte) (int, error) {
+	memzero(ba)
+	return len(ba), nil
+}
+
+func TestReadFromLocks(t *testing.T) {
+	s := newTestStore(t)
+	if err := s.RotateMasterKey(map[string][]byte{"default": []byte("test")}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.ReadFrom(bytes.NewReader(writeStore(t, newTestStore(t)))); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Unlocked() || s.key != [32]byte{} || s.dataKey != [32]byte{} {
+		t.Error("keys still set after ReadFrom")
+	}
+}
+
+func TestLegacyFormats(t *testing.T) {
+	for _, version := range []string{"v0", "v1"} {
+		s, err := Open("testdata/store-" + version)
+		if err != nil {
+			t.Fatalf("%s: %v", version, err)
+		}
+		defer s.Close()
+
+		if !s.NeedsUpgrade() {
+			t.Errorf("%s: should need an upgrade", version)
+		}
+		if keys := s.Keys(); len(keys) != 2 {
+			t.Errorf("%s: unexpected keys: %+v", version, keys)
+		}
+
+		// upgrade the slots with cheap KDF parameters
+		s.Rehash(testKDFParams)
+
+		if !s.Unlock([]byte(version + " second passphrase")) {
+			t.Fatalf("%s: failed to unlock with the second passphrase", version)
+		}
+		if !s.Unlock([]byte(version + " passphrase")) {
+			t.Fatalf("%s: failed to unlock", version)
+		}
+
+		readStream := func(s *Store) {
+			t.Helper()
+
+			stream, err := os.ReadFile("testdata/store-" + version + ".stream")
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := decryptStream(s, stream)
+			if err != nil || string(data) != version+" secret data" {
+				t.Errorf("%s: got %q, %v", version, data, err)
+			}
+		}
+		readStream(s)
+
+		// saved in the current format
+		upgraded, err := readStore(writeStore(t, s))
+		if err != nil {
+			t.Fatalf("%s: %v", version, err)
+		}
+		defer upgraded.Close()
+
+		if upgraded.NeedsUpgrade() {
+			t.Errorf("%s: should not need an upgrade anymore", version)
+		}
+		for _, k := range upgraded.Keys() {
+			if k.Kind != "passphrase" {
+				t.Errorf("%s: slot %s not upgraded: %+v", version, k.Label, k)
+			}
+		}
+
+		if !upgraded.Unlock([]byte(version + " passphrase")) {
+			t.Fatalf("%s: failed to unlock the upgraded store", version)
+		}
+		readStream(upgraded)
+	}
+}
@@ -0,0 +1,51 @@
+package secretstore
+
+import (
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const kdfArgon2id = "argon2id"
+
+// KDFParams are the parameters deriving a key from a passphrase.
+type KDFParams struct {
+	// Algorithm is the KDF; only "argon2id" is supported.
+	Algorithm string `json:"alg"`
+	Time      uint32 `json:"t"`
+	// Memory is in KiB
+	Memory  uint32 `json:"m"`
+	Threads uint8  `json:"p"`
+}
+
+var (
+	// DefaultKDFParams are used by Init, and as the target of stores read from older formats.
+	DefaultKDFParams = KDFParams{Algorithm: kdfArgon2id, Time: 3, Memory: 64 * 1024, Threads: 4}
+
+	// legacyKDFParams were the hardcoded parameters of v0 and v1 stores
+	legacyKDFParams = KDFParams{Algorithm: kdfArgon2id, Time: 1, Memory: 64 * 1024, Threads: 4}
+)
+
+const (
+	maxKDFTime   = 1000
+	maxKDFMemory = 4 << 20 // 4GiB
+)
+
+func (p KDFParams) validate() error {
+	if p.Algorithm != kdfArgon2id {
+		return fmt.Errorf("unsupported KDF: %q", p.Algorithm)
+	}
+
+	if p.Time < 1 || p.Time > maxKDFTime || p.Threads < 1 || p.Memory < 8*uint32(p.Threads) || p.Memory > maxKDFMemory {
+		return fmt.Errorf("invalid KDF parameters: t=%d m=%d p=%d", p.Time, p.Memory, p.Threads)
+	}
+	return nil
+}
+
+func deriveKey(passphrase, salt []byte, p KDFParams) (key [32]byte) {
+	keySlice := argon2.IDKey(passphrase, salt, p.Time, p.Memory, p.Threads, 32)
+
+	copy(key[:], keySlice)
+	memzero(keySlice)
+	return
+}
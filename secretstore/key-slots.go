@@ -0,0 +1,312 @@
+package secretstore
+
+import (
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	ErrNoSuchKey      = errors.New("no such key")
+	ErrLastKey        = errors.New("can't remove the last key")
+	ErrDuplicateLabel = errors.New("a key with this label already exists")
+	ErrBadPassphrase  = errors.New("no key matches the passphrase")
+	ErrLocked         = errors.New("store is locked")
+	ErrMissingSecret  = errors.New("no secret given for the keys")
+	ErrRecipientKey   = errors.New("recipient keys have no secret")
+)
+
+// KeyInfo describes a key slot.
+type KeyInfo struct {
+	Label string
+	Kind  string
+	// KDF are the parameters of passphrase slots
+	KDF KDFParams
+	// Recipient is the public key of x25519 (hex) and ssh-ed25519 (authorized key format) slots
+	Recipient string
+	Created   time.Time
+	LastUsed  time.Time
+}
+
+// Keys returns the key slots of the store.
+func (s *Store) Keys() (keys []KeyInfo) {
+	keys = make([]KeyInfo, 0, len(s.keys))
+	for _, k := range s.keys {
+		keys = append(keys, KeyInfo{
+			Label:     k.label,
+			Kind:      slotKinds[k.kind],
+			KDF:       k.kdf,
+			Recipient: k.recipientString(),
+			Created:   k.created,
+			LastUsed:  k.lastUsed,
+		})
+	}
+	return
+}
+
+// AddLabeledKey adds a passphrase slot. The store must be unlocked.
+func (s *Store) AddLabeledKey(label string, passphrase []byte) (err error) {
+	defer memzero(passphrase)
+
+	if err = s.checkNewSlot(label); err != nil {
+		return
+	}
+
+	k, err := s.newSlot(passphrase)
+	if err != nil {
+		return
+	}
+
+	k.label = label
+	s.keys = append(s.keys, k)
+	return
+}
+
+// RemoveKey removes the slot with the given label, unless it's the last one.
+func (s *Store) RemoveKey(label string) (err error) {
+	idx := s.slotIndex(label)
+	if idx == -1 {
+		return ErrNoSuchKey
+	}
+	if len(s.keys) == 1 {
+		return ErrLastKey
+	}
+
+	s.keys = append(s.keys[:idx], s.keys[idx+1:]...)
+	return
+}
+
+// ChangePassphrase replaces the passphrase of the slot opened by oldPassphrase, keeping its label.
+// It also unlocks the store.
+func (s *Store) ChangePassphrase(oldPassphrase, newPassphrase []byte) (err error) {
+	defer memzero(oldPassphrase)
+	defer memzero(newPassphrase)
+
+	idx := s.openSlot(oldPassphrase)
+	if idx == -1 {
+		return ErrBadPassphrase
+	}
+
+	if err = s.unlockDataKey(); err != nil {
+		return
+	}
+	s.unlocked = true
+
+	k, err := s.newSlot(newPassphrase)
+	if err != nil {
+		return
+	}
+
+	prev := s.keys[idx]
+	k.label, k.created, k.lastUsed = prev.label, prev.created, time.Now()
+
+	s.keys[idx] = k
+	return
+}
+
+// RotateMasterKey replaces the master key and the data key, so copies of the store made before can't open anything
+// written after, even with the passphrase of a removed slot.
+//
+// Every slot is wrapped again with the new master key. Recipient slots (x25519 and ssh-ed25519) only need their
+// public key, but passphrase and raw key slots need their secret, given in slotSecrets by label. ErrMissingSecret is
+// returned, with the labels, if some are missing (slots to drop must be removed with RemoveKey first),
+// ErrRecipientKey if a secret is given for a recipient slot, and ErrBadPassphrase if a secret doesn't open its slot.
+// The secrets are zeroed.
+//
+// The secrets of the vault are encrypted with the new data key, and the reencrypt hook is called with a copy of the
+// store still using the previous keys, so other data can be read with it and written with the store (ie using
+// prev.Reencrypt(out, in, s)). If it fails, the previous keys and slots are restored.
+func (s *Store) RotateMasterKey(slotSecrets map[string][]byte, reencrypt func(prev *Store) error) (err error) {
+	defer func() {
+		for _, secret := range slotSecrets {
+			memzero(secret)
+		}
+	}()
+
+	if !s.unlocked {
+		return ErrLocked
+	}
+
+	for label, secret := range slotSecrets {
+		idx := s.slotIndex(label)
+		if idx == -1 {
+			return ErrNoSuchKey
+		}
+		if !s.keys[idx].hasSecret() {
+			return fmt.Errorf("%w: %s", ErrRecipientKey, label)
+		}
+		if !s.opensSlot(&s.keys[idx], secret) {
+			return ErrBadPassphrase
+		}
+	}
+
+	missing := make([]string, 0)
+	for _, k := range s.keys {
+		if _, ok := slotSecrets[k.label]; k.hasSecret() && !ok {
+			missing = append(missing, k.label)
+		}
+	}
+	if len(missing) != 0 {
+		return fmt.Errorf("%w: %s", ErrMissingSecret, strings.Join(missing, ", "))
+	}
+
+	prev := New()
+	defer prev.Close()
+
+	prev.unlocked = true
+	prev.key = s.key
+	prev.dataKey = s.dataKey
+	prev.salt = s.salt
+
+	prevEncDataKey := s.encDataKey
+	prevSecrets := s.secrets
+	prevKeys := s.keys
+
+	defer func() {
+		if err != nil {
+			s.key = prev.key
+			s.dataKey = prev.dataKey
+			s.encDataKey = prevEncDataKey
+			s.secrets = prevSecrets
+			s.keys = prevKeys
+		}
+	}()
+
+	if err = randRead(s.key[:]); err != nil {
+		return
+	}
+	if err = randRead(s.dataKey[:]); err != nil {
+		return
+	}
+
+	if s.keys, err = s.rewrapSlots(slotSecrets); err != nil {
+		return
+	}
+
+	if s.encDataKey, err = s.seal(&s.key, s.dataKey[:], dataKeyAD); err != nil {
+		return
+	}
+
+	if s.secrets, err = s.resealSecrets(prev); err != nil {
+		return
+	}
+
+	if reencrypt != nil {
+		err = reencrypt(prev)
+	}
+	return
+}
+
+// rewrapSlots returns the slots wrapping the master key again, keeping their label and times. slotSecrets must have
+// the secrets of the passphrase and raw key slots.
+func (s *Store) rewrapSlots(slotSecrets map[string][]byte) (keys []keyEntry, err error) {
+	keys = make([]keyEntry, 0, len(s.keys))
+
+	for _, k := range s.keys {
+		var nk keyEntry
+
+		switch k.kind {
+		case slotLegacy, slotPassphrase:
+			nk, err = s.newSlot(slotSecrets[k.label])
+
+		case slotRawKey:
+			nk, err = s.newRawKeySlot(slotSecrets[k.label])
+
+		case slotX25519:
+			recipient := [32]byte{}
+			copy(recipient[:], k.recipient)
+			nk, err = s.newRecipientSlot(slotX25519, &recipient)
+
+		case slotSSH:
+			var pub ssh.PublicKey
+			if pub, err = ssh.ParsePublicKey(k.recipient); err != nil {
+				return
+			}
+
+			var recipient [32]byte
+			if recipient, err = sshRecipient(pub); err != nil {
+				return
+			}
+			nk, err = s.newRecipientSlot(slotSSH, &recipient)
+
+		default:
+			err = fmt.Errorf("unknown key slot kind: %d", k.kind)
+		}
+
+		if err != nil {
+			return
+		}
+
+		nk.label, nk.recipient, nk.created, nk.lastUsed = k.label, k.recipient, k.created, k.lastUsed
+		keys = append(keys, nk)
+	}
+	return
+}
+
+// opensSlot tells if the passphrase or raw key opens the slot.
+func (s *Store) opensSlot(k *keyEntry, secret []byte) bool {
+	var key [32]byte
+	defer memzero(key[:])
+
+	switch k.kind {
+	case slotLegacy:
+		key = deriveKey(secret, k.salt, k.kdf)
+		return sha512.Sum512(key[:]) == k.hash
+	case slotPassphrase:
+		key = deriveKey(secret, k.salt, k.kdf)
+	case slotRawKey:
+		key = deriveSlotKey(secret, k.salt, slotRawKey)
+	default:
+		return false
+	}
+
+	// the master key is set to the same value if it succeeds
+	return s.unwrapKey(k.encKey, &key)
+}
+
+// unlockDataKey sets the data key once the master key is known.
+func (s *Store) unlockDataKey() (err error) {
+	if s.encDataKey == nil {
+		s.dataKey = s.key
+		return
+	}
+
+	dataKey, err := s.open(&s.key, s.encDataKey, dataKeyAD)
+	if err != nil {
+		return
+	}
+
+	defer memzero(dataKey)
+
+	if len(dataKey) != len(s.dataKey) {
+		return ErrCorrupted
+	}
+
+	copy(s.dataKey[:], dataKey)
+	return
+}
+
+const dataKeyAD = "data key"
+
+func (s *Store) slotIndex(label string) int {
+	for i, k := range s.keys {
+		if k.label == label {
+			return i
+		}
+	}
+	return -1
+}
+
+// newLabel returns an unused label, for unlabeled slots.
+func (s *Store) newLabel() string {
+	for n := len(s.keys) + 1; ; n++ {
+		label := fmt.Sprint("key-", n)
+		if s.slotIndex(label) == -1 {
+			return label
+		}
+	}
+}
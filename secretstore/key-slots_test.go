@@ -0,0 +1,245 @@
+package secretstore
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestKeySlots(t *testing.T) {
+	s := newTestStore(t)
+
+	if err := s.AddLabeledKey("second", []byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddLabeledKey("second", []byte("other")); err != ErrDuplicateLabel {
+		t.Errorf("expected ErrDuplicateLabel, got %v", err)
+	}
+	if err := s.AddKey([]byte("third")); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := s.Keys()
+	if len(keys) != 3 || keys[2].Label != "key-3" || keys[2].Kind != "passphrase" {
+		t.Errorf("unexpected keys: %+v", keys)
+	}
+
+	if err := s.RemoveKey("nope"); err != ErrNoSuchKey {
+		t.Errorf("expected ErrNoSuchKey, got %v", err)
+	}
+	if err := s.RemoveKey("key-3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ChangePassphrase([]byte("second"), []byte("changed")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ChangePassphrase([]byte("second"), []byte("changed")); err != ErrBadPassphrase {
+		t.Errorf("expected ErrBadPassphrase, got %v", err)
+	}
+
+	s2, err := readStore(writeStore(t, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+
+	for passphrase, ok := range map[string]bool{"test": true, "changed": true, "second": false, "third": false} {
+		if s2.Unlock([]byte(passphrase)) != ok {
+			t.Errorf("unlock with %q: expected %v", passphrase, ok)
+		}
+	}
+
+	if err := s2.RemoveKey("second"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s2.RemoveKey("default"); err != ErrLastKey {
+		t.Errorf("expected ErrLastKey, got %v", err)
+	}
+}
+
+func TestRotateMasterKey(t *testing.T) {
+	s := newTestStore(t)
+
+	rawKey, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, recipient, err := GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPub, sshKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPublicKey, err := ssh.NewPublicKey(sshPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, err := range []error{
+		s.AddLabeledKey("leaked", []byte("leaked")),
+		s.AddLabeledKey("forgotten", []byte("forgotten")),
+		s.AddRawKey("ci", rawKey),
+		s.AddRecipient("age", recipient),
+		s.AddSSHKey("ssh", sshPublicKey),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := s.PutSecret("old", []byte("old value")); err != nil {
+		t.Fatal(err)
+	}
+	oldStream := encryptStream(t, s, []byte("old stream"))
+
+	// a copy of the store file is taken, then the leaked passphrase is removed
+	oldFile := writeStore(t, s)
+
+	if err := s.RemoveKey("leaked"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a wrong secret changes nothing
+	if err := s.RotateMasterKey(map[string][]byte{"default": []byte("wrong")}, nil); err != ErrBadPassphrase {
+		t.Errorf("expected ErrBadPassphrase, got %v", err)
+	}
+	if err := s.RotateMasterKey(map[string][]byte{"nope": []byte("test")}, nil); err != ErrNoSuchKey {
+		t.Errorf("expected ErrNoSuchKey, got %v", err)
+	}
+	if err := s.RotateMasterKey(map[string][]byte{"age": []byte("test")}, nil); !errors.Is(err, ErrRecipientKey) {
+		t.Errorf("expected ErrRecipientKey, got %v", err)
+	}
+
+	// every secret slot must be given its secret, or be removed first
+	err = s.RotateMasterKey(map[string][]byte{"default": []byte("test"), "ci": bytes.Clone(rawKey)}, nil)
+	if !errors.Is(err, ErrMissingSecret) || err.Error() != ErrMissingSecret.Error()+": forgotten" {
+		t.Errorf("expected ErrMissingSecret for forgotten, got %v", err)
+	}
+	if err := s.RemoveKey("forgotten"); err != nil {
+		t.Fatal(err)
+	}
+
+	var newStream []byte
+	err = s.RotateMasterKey(map[string][]byte{"default": []byte("test"), "ci": bytes.Clone(rawKey)}, func(prev *Store) error {
+		out := &bytes.Buffer{}
+		if err := prev.Reencrypt(out, bytes.NewReader(oldStream), s); err != nil {
+			return err
+		}
+		newStream = out.Bytes()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the slots are kept
+	labels := []string{}
+	for _, k := range s.Keys() {
+		labels = append(labels, k.Label)
+	}
+	if got := fmt.Sprint(labels); got != "[default ci age ssh]" {
+		t.Errorf("unexpected slots: %s", got)
+	}
+
+	if _, err := s.PutSecret("new", []byte("new value")); err != nil {
+		t.Fatal(err)
+	}
+	newFile := writeStore(t, s)
+
+	for name, unlock := range map[string]func(s *Store) bool{
+		"passphrase": func(s *Store) bool { return s.Unlock([]byte("test")) },
+		"raw key":    func(s *Store) bool { return s.UnlockWithKey(bytes.Clone(rawKey)) },
+		"identity":   func(s *Store) bool { return s.UnlockWithIdentity(identity) },
+		"ssh":        func(s *Store) bool { return s.UnlockWithSSHKey(sshKey) },
+	} {
+		s2, err := readStore(newFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !unlock(s2) {
+			t.Errorf("%s: failed to unlock", name)
+			continue
+		}
+		for secret, value := range map[string]string{"old": "old value", "new": "new value"} {
+			if v, err := s2.GetSecret(secret); err != nil || string(v) != value {
+				t.Errorf("%s: %s: got %q, %v", name, secret, v, err)
+			}
+		}
+		if data, err := decryptStream(s2, newStream); err != nil || string(data) != "old stream" {
+			t.Errorf("%s: reencrypted stream: %q, %v", name, data, err)
+		}
+		s2.Close()
+	}
+
+	// the old file still opens with the leaked passphrase...
+	old, err := readStore(oldFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+
+	if !old.Unlock([]byte("leaked")) {
+		t.Fatal("failed to unlock the old file")
+	}
+
+	// ...but its keys can't read what's written since
+	leaked, err := readStore(newFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leaked.Close()
+
+	leaked.key = old.key
+	if err := leaked.unlockDataKey(); err != ErrAuthFailed {
+		t.Errorf("old master key: expected ErrAuthFailed, got %v", err)
+	}
+
+	leaked.dataKey, leaked.unlocked = old.dataKey, true
+	if _, err := leaked.GetSecret("new"); err == nil {
+		t.Error("old data key: read a new secret")
+	}
+	if _, err := decryptStream(leaked, encryptStream(t, s, []byte("new stream"))); err == nil {
+		t.Error("old data key: read a new stream")
+	}
+}
+
+func TestRotateMasterKeyRestore(t *testing.T) {
+	s := newTestStore(t)
+	if _, err := s.PutSecret("a", []byte("A")); err != nil {
+		t.Fatal(err)
+	}
+	stream := encryptStream(t, s, []byte("stream"))
+	file := writeStore(t, s)
+
+	// no secret for the passphrase slot
+	if err := s.RotateMasterKey(nil, nil); !errors.Is(err, ErrMissingSecret) {
+		t.Errorf("expected ErrMissingSecret, got %v", err)
+	}
+
+	failure := errors.New("reencrypt failed")
+	if err := s.RotateMasterKey(map[string][]byte{"default": []byte("test")}, func(*Store) error { return failure }); err != failure {
+		t.Errorf("expected the hook's error, got %v", err)
+	}
+
+	if !bytes.Equal(writeStore(t, s), file) {
+		t.Error("store changed by failed rotations")
+	}
+	if v, err := s.GetSecret("a"); err != nil || string(v) != "A" {
+		t.Errorf("got %q, %v", v, err)
+	}
+	if data, err := decryptStream(s, stream); err != nil || string(data) != "stream" {
+		t.Errorf("got %q, %v", data, err)
+	}
+
+	s.Close()
+	if err := s.RotateMasterKey(nil, nil); err != ErrLocked {
+		t.Errorf("expected ErrLocked, got %v", err)
+	}
+}
@@ -1,68 +1,322 @@
 package secretstore
 
 import (
+	"bufio"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Streams are encrypted with AES-256-GCM using the STREAM construction: the plaintext is cut in chunks, each sealed
+// with a nonce made of the chunk counter and a flag set on the last chunk, so reordered, truncated or modified streams
+// are detected. Each stream has its own key, derived from the data key and a random salt stored in the header, so
+// nonces are never reused. The header is authenticated with every chunk.
+//
+// Version 1 streams used the data key directly, with a random 7 bytes nonce prefix in a 16 bytes header; they can
+// still be read. Legacy (v0) streams are a random IV followed by the AES-CFB encrypted data; they can still be read.
+
+const (
+	streamMagic      = "\x00SSTREAM"
+	streamVersion    = 2
+	streamSaltLen    = 32
+	streamHeaderLen  = len(streamMagic) + 1 + streamSaltLen // magic, version, salt
+	streamChunkSize  = 64 << 10
+	streamMaxCounter = 1<<32 - 1
+
+	legacyHeaderLen = 16 // the legacy IV, or a version 1 header: magic, version, nonce prefix
+	v1PrefixLen     = 7
+)
+
+var (
+	ErrTruncated     = errors.New("encrypted stream is truncated")
+	ErrAuthFailed    = errors.New("message authentication failed")
+	ErrUnsupported   = errors.New("unsupported format version")
+	errStreamTooLong = errors.New("encrypted stream is too long")
 )
 
+// NewReader returns a reader decrypting a stream written by NewWriter. Legacy (unauthenticated) streams are also
+// supported. Reads fail with ErrAuthFailed if the stream was modified, or ErrTruncated if it's incomplete.
 func (s *Store) NewReader(reader io.Reader) (r io.Reader, err error) {
-	iv := [aes.BlockSize]byte{}
+	header := make([]byte, streamHeaderLen)
 
-	err = readFull(reader, iv[:])
+	err = readFull(reader, header[:legacyHeaderLen])
 	if err != nil {
 		return
 	}
 
-	r = storeReader{reader, s.NewDecrypter(iv)}
+	if string(header[:len(streamMagic)]) != streamMagic {
+		// legacy stream: the header is the IV
+		r = storeReader{reader, s.NewDecrypter([legacyHeaderLen]byte(header[:legacyHeaderLen]))}
+		return
+	}
+
+	sr := &streamReader{
+		in: bufio.NewReaderSize(reader, streamChunkSize+aeadOverhead+1),
+	}
+
+	switch header[len(streamMagic)] {
+	case 1:
+		sr.header = header[:legacyHeaderLen]
+		sr.prefix = header[len(streamMagic)+1 : legacyHeaderLen]
+		sr.aead = s.aead()
+
+	case streamVersion:
+		err = readFull(reader, header[legacyHeaderLen:])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = ErrTruncated
+		}
+		if err != nil {
+			return
+		}
+
+		sr.header = header
+		sr.aead = s.streamAEAD(header[len(streamMagic)+1:])
+
+	default:
+		err = ErrUnsupported
+		return
+	}
+
+	r = sr
 	return
 }
 
-type storeReader struct {
-	reader    io.Reader
-	decrypter cipher.Stream
-}
+// NewWriter returns a writer encrypting to writer. It must be closed to write the last chunk, without which the
+// stream is detected as truncated. Closing it does not close writer.
+func (s *Store) NewWriter(writer io.Writer) (w io.WriteCloser, err error) {
+	sw := &streamWriter{
+		out: writer,
+		buf: make([]byte, 0, streamChunkSize+aeadOverhead),
+	}
 
-func (r storeReader) Read(ba []byte) (n int, err error) {
-	n, err = r.reader.Read(ba)
+	copy(sw.header[:], streamMagic)
+	sw.header[len(streamMagic)] = streamVersion
 
-	if n > 0 {
-		r.decrypter.XORKeyStream(ba[:n], ba[:n])
+	salt := sw.header[len(streamMagic)+1:]
+	if err = randRead(salt); err != nil {
+		return
 	}
 
+	sw.aead = s.streamAEAD(salt)
+
+	if _, err = writer.Write(sw.header[:]); err != nil {
+		return
+	}
+
+	w = sw
 	return
 }
 
-func (s *Store) NewWriter(writer io.Writer) (r io.Writer, err error) {
-	iv := [aes.BlockSize]byte{}
+// Reencrypt copies the stream in to out, decrypting it with the store's key and encrypting it with the newKey store's
+// key (or the same store if newKey is nil). It upgrades legacy streams to the current format.
+func (s *Store) Reencrypt(out io.Writer, in io.Reader, newKey *Store) (err error) {
+	if newKey == nil {
+		newKey = s
+	}
 
-	if err = randRead(iv[:]); err != nil {
+	r, err := s.NewReader(in)
+	if err != nil {
 		return
 	}
 
-	_, err = writer.Write(iv[:])
+	w, err := newKey.NewWriter(out)
 	if err != nil {
 		return
 	}
 
-	r = storeWriter{writer, s.NewEncrypter(iv)}
+	if _, err = io.Copy(w, r); err != nil {
+		return
+	}
+
+	return w.Close()
+}
+
+// streamAEAD returns the AEAD of a stream, keyed with HKDF-SHA256(data key, salt).
+func (s *Store) streamAEAD(salt []byte) cipher.AEAD {
+	if !s.unlocked {
+		panic("not unlocked")
+	}
+
+	key := [32]byte{}
+	defer memzero(key[:])
+
+	if _, err := io.ReadFull(hkdf.New(sha256.New, s.dataKey[:], salt, []byte(streamMagic)), key[:]); err != nil {
+		panic(fmt.Errorf("failed to derive the stream key: %w", err))
+	}
+
+	return newGCM(key[:])
+}
+
+// streamNonce returns the nonce of a chunk. The prefix is only set in version 1 streams.
+func streamNonce(prefix []byte, counter uint32, last bool) (nonce [12]byte) {
+	copy(nonce[:v1PrefixLen], prefix)
+	binary.BigEndian.PutUint32(nonce[v1PrefixLen:], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return
+}
+
+type streamReader struct {
+	in      *bufio.Reader
+	aead    cipher.AEAD
+	header  []byte
+	prefix  []byte // version 1 nonce prefix
+	counter uint64
+	buf     []byte // decrypted data not read yet
+	done    bool
+}
+
+func (r *streamReader) Read(ba []byte) (n int, err error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+
+		if err = r.readChunk(); err != nil {
+			return
+		}
+	}
+
+	n = copy(ba, r.buf)
+	r.buf = r.buf[n:]
+	return
+}
+
+func (r *streamReader) readChunk() (err error) {
+	if r.counter > streamMaxCounter {
+		return errStreamTooLong
+	}
+
+	chunk := make([]byte, streamChunkSize+aeadOverhead)
+
+	n, err := io.ReadFull(r.in, chunk)
+	full := n == len(chunk)
+
+	switch err {
+	case nil:
+	case io.ErrUnexpectedEOF:
+		err = nil
+	case io.EOF:
+		return ErrTruncated
+	default:
+		return
+	}
+	chunk = chunk[:n]
+
+	// the last chunk is the one not followed by more data
+	last := true
+	if full {
+		if _, peekErr := r.in.Peek(1); peekErr == nil {
+			last = false
+		}
+	}
+
+	nonce := streamNonce(r.prefix, uint32(r.counter), last)
+
+	r.buf, err = r.aead.Open(chunk[:0], nonce[:], chunk, r.header)
+	if err != nil {
+		if last {
+			// can't tell a modified last chunk from a chunk followed by a missing last one
+			return ErrTruncated
+		}
+		return ErrAuthFailed
+	}
+
+	r.counter++
+	r.done = last
 	return
 }
 
-type storeWriter struct {
-	writer    io.Writer
-	encrypter cipher.Stream
+type streamWriter struct {
+	out     io.Writer
+	aead    cipher.AEAD
+	header  [streamHeaderLen]byte
+	counter uint64
+	buf     []byte
+	closed  bool
 }
 
-func (r storeWriter) Write(ba []byte) (n int, err error) {
-	if len(ba) == 0 {
+func (w *streamWriter) Write(ba []byte) (n int, err error) {
+	if w.closed {
+		return 0, errors.New("write on closed stream")
+	}
+
+	for len(ba) != 0 {
+		if len(w.buf) == streamChunkSize {
+			// only flush when more data comes, so the last chunk is written by Close
+			if err = w.flush(false); err != nil {
+				return
+			}
+		}
+
+		c := copy(w.buf[len(w.buf):streamChunkSize], ba)
+		w.buf = w.buf[:len(w.buf)+c]
+		ba = ba[c:]
+		n += c
+	}
+	return
+}
+
+func (w *streamWriter) Close() (err error) {
+	if w.closed {
 		return
 	}
+	w.closed = true
 
-	encBA := make([]byte, len(ba))
-	r.encrypter.XORKeyStream(encBA, ba)
+	err = w.flush(true)
+	memzero(w.buf[:cap(w.buf)])
+	return
+}
 
-	n, err = r.writer.Write(encBA)
+func (w *streamWriter) flush(last bool) (err error) {
+	if w.counter > streamMaxCounter {
+		return errStreamTooLong
+	}
+
+	nonce := streamNonce(nil, uint32(w.counter), last)
+	sealed := w.aead.Seal(w.buf[:0], nonce[:], w.buf, w.header[:])
+
+	_, err = w.out.Write(sealed)
+
+	w.buf = w.buf[:0]
+	w.counter++
+	return
+}
+
+// storeReader reads legacy streams.
+type storeReader struct {
+	reader    io.Reader
+	decrypter cipher.Stream
+}
+
+func (r storeReader) Read(ba []byte) (n int, err error) {
+	n, err = r.reader.Read(ba)
+
+	if n > 0 {
+		r.decrypter.XORKeyStream(ba[:n], ba[:n])
+	}
 
 	return
 }
+
+func newGCM(key []byte) cipher.AEAD {
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		panic(fmt.Errorf("failed to init AES: %w", err))
+	}
+
+	aead, err := cipher.NewGCM(c)
+	if err != nil {
+		panic(fmt.Errorf("failed to init GCM: %w", err))
+	}
+	return aead
+}
+
+const aeadOverhead = 16
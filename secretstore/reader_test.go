@@ -0,0 +1,228 @@
+package secretstore
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+const sealedChunkSize = streamChunkSize + aeadOverhead
+
+func encryptStream(t *testing.T, s *Store, data []byte) []byte {
+	t.Helper()
+
+	out := &bytes.Buffer{}
+	w, err := s.NewWriter(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func decryptStream(s *Store, stream []byte) (data []byte, err error) {
+	r, err := s.NewReader(bytes.NewReader(stream))
+	if err != nil {
+		return
+	}
+	return io.ReadAll(r)
+}
+
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	s := newTestStore(t)
+
+	for _, size := range []int{0, 1, 100, streamChunkSize - 1, streamChunkSize, streamChunkSize + 1, 3 * streamChunkSize} {
+		data := testData(size)
+		stream := encryptStream(t, s, data)
+
+		chunks := size/streamChunkSize + 1
+		if size != 0 && size%streamChunkSize == 0 {
+			// an exact multiple of the chunk size has a full last chunk
+			chunks--
+		}
+		if expected := streamHeaderLen + size + chunks*aeadOverhead; len(stream) != expected {
+			t.Errorf("size %d: expected a %d bytes stream, got %d", size, expected, len(stream))
+		}
+
+		decrypted, err := decryptStream(s, stream)
+		if err != nil {
+			t.Errorf("size %d: %v", size, err)
+		} else if !bytes.Equal(decrypted, data) {
+			t.Errorf("size %d: decrypted data differs", size)
+		}
+	}
+}
+
+func TestStreamTampering(t *testing.T) {
+	s := newTestStore(t)
+
+	stream := encryptStream(t, s, testData(3*streamChunkSize+10))
+	chunk := func(i int) []byte {
+		start := streamHeaderLen + i*sealedChunkSize
+		end := start + sealedChunkSize
+		if end > len(stream) {
+			end = len(stream)
+		}
+		return stream[start:end]
+	}
+
+	exact := encryptStream(t, s, testData(2*streamChunkSize))
+
+	concat := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+	for _, tc := range []struct {
+		name   string
+		stream []byte
+		err    error
+	}{
+		{"cut in the header", stream[:streamHeaderLen-1], ErrTruncated},
+		{"header only", stream[:streamHeaderLen], ErrTruncated},
+		{"without the last chunk", stream[:streamHeaderLen+3*sealedChunkSize], ErrTruncated},
+		{"without the last chunk of an exact multiple", exact[:streamHeaderLen+sealedChunkSize], ErrTruncated},
+		{"cut in a chunk", stream[:streamHeaderLen+sealedChunkSize+100], ErrTruncated},
+		{"reordered chunks", concat(stream[:streamHeaderLen], chunk(1), chunk(0), chunk(2), chunk(3)), ErrAuthFailed},
+		{"duplicated chunk", concat(stream[:streamHeaderLen], chunk(0), chunk(0), chunk(1), chunk(2), chunk(3)), ErrAuthFailed},
+		// the last chunk is the one not followed by a full chunk, so it's seen as modified
+		{"appended data", concat(stream, []byte{0}), ErrTruncated},
+	} {
+		if _, err := decryptStream(s, tc.stream); err != tc.err {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.err, err)
+		}
+	}
+
+	// a flipped bit anywhere after the magic and version is detected
+	for _, pos := range []int{len(streamMagic) + 1, streamHeaderLen, streamHeaderLen + sealedChunkSize + 42, len(stream) - 1} {
+		flipped := bytes.Clone(stream)
+		flipped[pos] ^= 1
+
+		if _, err := decryptStream(s, flipped); err != ErrAuthFailed && err != ErrTruncated {
+			t.Errorf("bit flipped at %d: expected an authentication failure, got %v", pos, err)
+		}
+	}
+
+	version := bytes.Clone(stream)
+	version[len(streamMagic)]++
+	if _, err := decryptStream(s, version); err != ErrUnsupported {
+		t.Errorf("expected ErrUnsupported, got %v", err)
+	}
+
+	// another key can't read it
+	if _, err := decryptStream(newTestStore(t), stream); err != ErrAuthFailed {
+		t.Errorf("other key: expected ErrAuthFailed, got %v", err)
+	}
+}
+
+func TestStreamKeys(t *testing.T) {
+	s := newTestStore(t)
+
+	data := testData(100)
+	stream1 := encryptStream(t, s, data)
+	stream2 := encryptStream(t, s, data)
+
+	if bytes.Equal(stream1[:streamHeaderLen], stream2[:streamHeaderLen]) {
+		t.Fatal("streams should have different salts")
+	}
+	if bytes.Equal(stream1[streamHeaderLen:], stream2[streamHeaderLen:]) {
+		t.Error("streams should be encrypted with different keys")
+	}
+
+	// the chunks only open with the key derived from their own salt
+	swapped := append(bytes.Clone(stream1[:streamHeaderLen]), stream2[streamHeaderLen:]...)
+	if _, err := decryptStream(s, swapped); err != ErrTruncated {
+		t.Errorf("expected ErrTruncated, got %v", err)
+	}
+}
+
+func TestWriterBuffering(t *testing.T) {
+	s := newTestStore(t)
+
+	out := &bytes.Buffer{}
+	w, err := s.NewWriter(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out.Len() != streamHeaderLen {
+		t.Fatalf("expected only the header to be written, got %d bytes", out.Len())
+	}
+
+	// a full chunk is only written once more data comes, as it could be the last one
+	w.Write(testData(streamChunkSize))
+	if out.Len() != streamHeaderLen {
+		t.Errorf("expected nothing written before the chunk is complete, got %d bytes", out.Len())
+	}
+
+	w.Write([]byte("more"))
+	if out.Len() != streamHeaderLen+sealedChunkSize {
+		t.Errorf("expected the first chunk to be written, got %d bytes", out.Len())
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() != streamHeaderLen+sealedChunkSize+len("more")+aeadOverhead {
+		t.Errorf("expected the last chunk to be written, got %d bytes", out.Len())
+	}
+
+	if err := w.Close(); err != nil {
+		t.Errorf("second close: %v", err)
+	}
+	if _, err := w.Write([]byte("x")); err == nil {
+		t.Error("expected writing after Close to fail")
+	}
+
+	decrypted, err := decryptStream(s, out.Bytes())
+	if err != nil || !bytes.Equal(decrypted, append(testData(streamChunkSize), "more"...)) {
+		t.Errorf("decrypted data differs: %v", err)
+	}
+}
+
+func TestLegacyStream(t *testing.T) {
+	s := newTestStore(t)
+
+	iv := [legacyHeaderLen]byte{}
+	copy(iv[:], "legacy stream iv")
+
+	data := testData(1000)
+	encrypted := make([]byte, len(data))
+	s.NewEncrypter(iv).XORKeyStream(encrypted, data)
+
+	legacy := append(iv[:], encrypted...)
+
+	decrypted, err := decryptStream(s, legacy)
+	if err != nil || !bytes.Equal(decrypted, data) {
+		t.Fatalf("decrypted data differs: %v", err)
+	}
+
+	// reencrypting upgrades it
+	out := &bytes.Buffer{}
+	if err = s.Reencrypt(out, bytes.NewReader(legacy), nil); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(out.Bytes(), []byte(streamMagic)) {
+		t.Error("reencrypted stream should be in the current format")
+	}
+
+	decrypted, err = decryptStream(s, out.Bytes())
+	if err != nil || !bytes.Equal(decrypted, data) {
+		t.Errorf("decrypted data differs: %v", err)
+	}
+
+	if _, err := decryptStream(s, iv[:10]); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
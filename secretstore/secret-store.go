@@ -5,31 +5,57 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/sha512"
-	"errors"
 	"fmt"
-	"io"
-	"log"
 	"os"
 	"syscall"
+	"time"
+)
+
+const (
+	slotLegacy     byte = 0
+	slotPassphrase byte = 1
+	slotRawKey     byte = 2
+	slotX25519     byte = 3
+	slotSSH        byte = 4
 
-	"golang.org/x/crypto/argon2"
+	wrappedKeyLen = 12 + 32 + aeadOverhead
 )
 
+// Store holds a master key, wrapped in key slots, each opened by a passphrase, a raw key or a private key. The master key encrypts the data key,
+// which encrypts the data; it's the master key itself until RotateMasterKey is called.
 type Store struct {
 	unlocked bool
 	key      [32]byte
+	dataKey  [32]byte
 	salt     [aes.BlockSize]byte
-	keys     []keyEntry
+	// kdf are the KDF parameters of new slots
+	kdf  KDFParams
+	keys []keyEntry
+	// encDataKey is the data key sealed with the master key (nil if it's the master key)
+	encDataKey []byte
+	secrets    map[string]*secretEntry
+	// version is the format version the store was read from
+	version byte
 }
 
 type keyEntry struct {
+	kind  byte
+	label string
+	// hash identifies the passphrase of legacy slots
 	hash   [64]byte
-	encKey [32]byte
+	kdf    KDFParams
+	salt   []byte
+	encKey []byte
+	// recipient is the public key of recipient slots
+	recipient []byte
+	created   time.Time
+	lastUsed  time.Time
 }
 
 func New() (s *Store) {
-	s = &Store{}
+	s = &Store{version: storeVersion, kdf: DefaultKDFParams}
 	syscall.Mlock(s.key[:])
+	syscall.Mlock(s.dataKey[:])
 	return
 }
 
@@ -67,12 +93,15 @@ func (s *Store) SaveTo(path string) (err error) {
 		return
 	}
 
+	s.version = storeVersion
 	return
 }
 
 func (s *Store) Close() {
 	memzero(s.key[:])
+	memzero(s.dataKey[:])
 	syscall.Munlock(s.key[:])
+	syscall.Munlock(s.dataKey[:])
 	s.unlocked = false
 }
 
@@ -84,7 +113,33 @@ func (s *Store) Unlocked() bool {
 	return s.unlocked
 }
 
+// NeedsUpgrade tells if the store was read from an older format, or still has legacy key slots or slots with other
+// KDF parameters than the store's (upgraded when unlocked with their passphrase). The store must be saved for the
+// upgrade to be persisted.
+func (s *Store) NeedsUpgrade() bool {
+	if s.version < storeVersion {
+		return true
+	}
+	for _, k := range s.keys {
+		if k.kind == slotLegacy || k.usesKDF() && k.kdf != s.kdf {
+			return true
+		}
+	}
+	return false
+}
+
+// Init initializes a new store with DefaultKDFParams.
 func (s *Store) Init(passphrase []byte) (err error) {
+	return s.InitWithParams(passphrase, DefaultKDFParams)
+}
+
+// InitWithParams initializes a new store, deriving the passphrase keys with the given KDF parameters.
+func (s *Store) InitWithParams(passphrase []byte, params KDFParams) (err error) {
+	if err = params.validate(); err != nil {
+		return
+	}
+	s.kdf = params
+
 	err = randRead(s.key[:])
 	if err != nil {
 		return
@@ -94,150 +149,212 @@ func (s *Store) Init(passphrase []byte) (err error) {
 		return
 	}
 
-	s.AddKey(passphrase)
-
+	s.dataKey = s.key
+	s.encDataKey = nil
 	s.unlocked = true
 
-	return
+	return s.AddLabeledKey("default", passphrase)
 }
 
-func (s *Store) ReadFrom(in io.Reader) (n int64, err error) {
-	memzero(s.key[:])
-	s.unlocked = false
+// Unlock unlocks the store with the passphrase. The slot matching the passphrase is upgraded if it's a legacy one,
+// or if its KDF parameters are not the store's. Its last use time is updated too, so the store should be saved.
+func (s *Store) Unlock(passphrase []byte) (ok bool) {
+	defer memzero(passphrase)
 
+	idx := s.openSlot(passphrase)
+	if idx == -1 {
+		return
+	}
+
+	if !s.unlockSlot(idx) {
+		return
+	}
+
+	k := &s.keys[idx]
+
+	if k.kind == slotLegacy || k.kdf != s.kdf {
+		if upgraded, err := s.newSlot(passphrase); err == nil {
+			upgraded.label, upgraded.created, upgraded.lastUsed = k.label, k.created, k.lastUsed
+			*k = upgraded
+		}
+	}
+
+	return true
+}
+
+// openSlot finds the slot opened by the passphrase, setting the master key. Returns -1 if there's none.
+func (s *Store) openSlot(passphrase []byte) (idx int) {
+	// slots read from older formats share the same salt
+	derived := map[string]*[32]byte{}
 	defer func() {
-		if err != nil {
-			log.Output(2, fmt.Sprintf("failed after %d bytes", n))
+		for _, key := range derived {
+			memzero(key[:])
 		}
 	}()
 
-	readFull := func(ba []byte) {
-		var nr int
-		nr, err = io.ReadFull(in, ba)
-		n += int64(nr)
-	}
+	for i, k := range s.keys {
+		if !k.usesKDF() {
+			continue
+		}
 
-	// read the salt
-	readFull(s.salt[:])
-	if err != nil {
-		return
-	}
+		id := fmt.Sprintf("%x/%+v", k.salt, k.kdf)
 
-	// read the (encrypted) keys
-	s.keys = make([]keyEntry, 0)
-	for {
-		k := keyEntry{}
-		readFull(k.hash[:])
-		if err != nil {
-			if err == io.EOF {
-				err = nil
-			}
-			return
+		key := derived[id]
+		if key == nil {
+			dk := deriveKey(passphrase, k.salt, k.kdf)
+			key = &dk
+			derived[id] = key
 		}
-		readFull(k.encKey[:])
-		if err != nil {
-			return
+
+		switch k.kind {
+		case slotLegacy:
+			if sha512.Sum512(key[:]) != k.hash {
+				continue
+			}
+
+			s.decryptTo(s.key[:], k.encKey, key)
+
+		case slotPassphrase:
+			if !s.unwrapKey(k.encKey, key) {
+				continue
+			}
+
+		default:
+			continue
 		}
 
-		s.keys = append(s.keys, k)
+		return i
 	}
+
+	return -1
+}
+
+// AddKey adds a passphrase slot, with a generated label.
+func (s *Store) AddKey(passphrase []byte) (err error) {
+	return s.AddLabeledKey(s.newLabel(), passphrase)
 }
 
-func (s *Store) WriteTo(out io.Writer) (n int64, err error) {
-	write := func(ba []byte) {
-		var nr int
-		nr, err = out.Write(ba)
-		n += int64(nr)
+// Rehash sets the KDF parameters of the store. Slots with other parameters are derived again with these when unlocked
+// (see NeedsUpgrade), and new slots use them.
+func (s *Store) Rehash(params KDFParams) (err error) {
+	if err = params.validate(); err != nil {
+		return
 	}
 
-	write(s.salt[:])
-	if err != nil {
+	s.kdf = params
+	return
+}
+
+// KDFParams returns the KDF parameters of the store.
+func (s *Store) KDFParams() KDFParams {
+	return s.kdf
+}
+
+// newSlot returns a passphrase slot holding the master key.
+func (s *Store) newSlot(passphrase []byte) (k keyEntry, err error) {
+	salt := make([]byte, 16)
+	if err = randRead(salt); err != nil {
 		return
 	}
 
-	for _, k := range s.keys {
-		write(k.hash[:])
-		if err != nil {
-			return
-		}
+	key := deriveKey(passphrase, salt, s.kdf)
+	defer memzero(key[:])
 
-		write(k.encKey[:])
-		if err != nil {
-			return
-		}
+	encKey, err := s.wrapKey(&key)
+	if err != nil {
+		return
 	}
 
+	k = keyEntry{
+		kind:    slotPassphrase,
+		kdf:     s.kdf,
+		salt:    salt,
+		encKey:  encKey,
+		created: time.Now(),
+	}
 	return
 }
 
-var ErrNoSuchKey = errors.New("no such key")
-
-func (s *Store) Unlock(passphrase []byte) (ok bool) {
-	key, hash := s.keyPairFromPassword(passphrase)
-	memzero(passphrase)
-	defer memzero(key[:])
+// wrapKey seals the master key with key, for a key slot.
+func (s *Store) wrapKey(key *[32]byte) (encKey []byte, err error) {
+	return s.seal(key, s.key[:], "")
+}
 
-	var idx = -1
-	for i := range s.keys {
-		if hash == s.keys[i].hash {
-			idx = i
-			break
-		}
+// unwrapKey opens a key slot with key, setting the master key if it succeeds.
+func (s *Store) unwrapKey(encKey []byte, key *[32]byte) (ok bool) {
+	if len(encKey) != wrappedKeyLen {
+		return
 	}
 
-	if idx == -1 {
+	masterKey, err := s.open(key, encKey, "")
+	if err != nil {
 		return
 	}
 
-	s.decryptTo(s.key[:], s.keys[idx].encKey[:], &key)
+	defer memzero(masterKey)
 
-	s.unlocked = true
+	if len(masterKey) != len(s.key) {
+		return
+	}
+
+	copy(s.key[:], masterKey)
 	return true
 }
 
-func (s *Store) AddKey(passphrase []byte) {
-	key, hash := s.keyPairFromPassword(passphrase)
-	memzero(passphrase)
-
-	defer memzero(key[:])
-
-	k := keyEntry{hash: hash}
-
-	encKey := s.encrypt(s.key[:], &key)
-	copy(k.encKey[:], encKey)
+// seal encrypts data with key, prefixed by a random nonce. The context is authenticated with the store's magic and salt.
+func (s *Store) seal(key *[32]byte, data []byte, context string) (sealed []byte, err error) {
+	nonce := make([]byte, 12, 12+len(data)+aeadOverhead)
+	if err = randRead(nonce); err != nil {
+		return
+	}
 
-	s.keys = append(s.keys, k)
+	sealed = newGCM(key[:]).Seal(nonce, nonce, data, s.additionalData(context))
+	return
 }
 
-func (s *Store) keyPairFromPassword(password []byte) (key [32]byte, hash [64]byte) {
-	keySlice := argon2.IDKey(password, s.salt[:], 1, 64*1024, 4, 32)
+func (s *Store) open(key *[32]byte, sealed []byte, context string) (data []byte, err error) {
+	if len(sealed) < 12+aeadOverhead {
+		return nil, ErrAuthFailed
+	}
 
-	copy(key[:], keySlice)
-	memzero(keySlice)
+	data, err = newGCM(key[:]).Open(nil, sealed[:12], sealed[12:], s.additionalData(context))
+	if err != nil {
+		err = ErrAuthFailed
+	}
+	return
+}
 
-	hash = sha512.Sum512(key[:])
+// additionalData binds sealed data to the store.
+func (s *Store) additionalData(context string) []byte {
+	ad := append([]byte(storeMagic), s.salt[:]...)
+	return append(ad, context...)
+}
 
-	return
+func (s *Store) aead() cipher.AEAD {
+	if !s.unlocked {
+		panic("not unlocked")
+	}
+	return newGCM(s.dataKey[:])
 }
 
+// NewEncrypter returns an unauthenticated AES-CFB stream with the master key.
+//
+// Deprecated: use NewWriter, which authenticates the data.
 func (s *Store) NewEncrypter(iv [aes.BlockSize]byte) cipher.Stream {
 	if !s.unlocked {
 		panic("not unlocked")
 	}
-	return newEncrypter(iv, &s.key)
+	return newEncrypter(iv, &s.dataKey)
 }
 
+// NewDecrypter returns an unauthenticated AES-CFB stream with the master key.
+//
+// Deprecated: use NewReader, which authenticates the data.
 func (s *Store) NewDecrypter(iv [aes.BlockSize]byte) cipher.Stream {
 	if !s.unlocked {
 		panic("not unlocked")
 	}
-	return newDecrypter(iv, &s.key)
-}
-
-func (s *Store) encrypt(src []byte, key *[32]byte) (dst []byte) {
-	dst = make([]byte, len(src))
-	newEncrypter(s.salt, key).XORKeyStream(dst, src)
-	return
+	return newDecrypter(iv, &s.dataKey)
 }
 
 func (s *Store) decryptTo(dst []byte, src []byte, key *[32]byte) {
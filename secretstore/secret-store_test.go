@@ -0,0 +1,19 @@
+package secretstore
+
+import "testing"
+
+// testKDFParams are the cheapest valid parameters, to keep tests fast.
+var testKDFParams = KDFParams{Algorithm: kdfArgon2id, Time: 1, Memory: 8, Threads: 1}
+
+// newTestStore returns an unlocked store with a "default" passphrase slot opened by "test".
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+
+	s := New()
+	if err := s.InitWithParams([]byte("test"), testKDFParams); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(s.Close)
+	return s
+}
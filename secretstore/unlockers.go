@@ -0,0 +1,446 @@
+package secretstore
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/ssh"
+)
+
+// minKeySize is the minimum size of raw keys
+const minKeySize = 16
+
+var (
+	ErrKeyTooShort = fmt.Errorf("key must be at least %d bytes", minKeySize)
+	ErrNotEd25519  = errors.New("only ssh-ed25519 keys are supported")
+)
+
+// GenerateKey returns a new random raw key.
+func GenerateKey() (key []byte, err error) {
+	key = make([]byte, 32)
+	err = randRead(key)
+	return
+}
+
+// EncodeKey encodes a raw key as text (standard base64), as expected by ReadKeyFile, KeyFromEnv and KeyFromFD.
+func EncodeKey(key []byte) string {
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// DecodeKey decodes a raw key encoded by EncodeKey. Surrounding whitespace, like a trailing newline, is ignored.
+func DecodeKey(encoded []byte) (key []byte, err error) {
+	encoded = bytes.TrimSpace(encoded)
+
+	key = make([]byte, base64.StdEncoding.DecodedLen(len(encoded)))
+	n, err := base64.StdEncoding.Decode(key, encoded)
+	if err != nil {
+		memzero(key)
+		return nil, fmt.Errorf("invalid key encoding: %w", err)
+	}
+	return key[:n], nil
+}
+
+// GenerateKeyFile writes a new random raw key to path, which must not exist.
+func GenerateKeyFile(path string) (key []byte, err error) {
+	key, err = GenerateKey()
+	if err != nil {
+		return
+	}
+
+	err = WriteKeyFile(path, key)
+	return
+}
+
+// WriteKeyFile writes a raw key, encoded by EncodeKey, to path, which must not exist.
+func WriteKeyFile(path string, key []byte) (err error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	if _, err = f.WriteString(EncodeKey(key) + "\n"); err != nil {
+		return
+	}
+	return f.Close()
+}
+
+// ReadKeyFile reads a raw key from a file written by WriteKeyFile (or any file holding a key encoded by EncodeKey).
+func ReadKeyFile(path string) (key []byte, err error) {
+	encoded, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	defer memzero(encoded)
+	return DecodeKey(encoded)
+}
+
+// KeyFromEnv reads a raw key encoded by EncodeKey from an environment variable, and unsets it so it's not passed to
+// child processes.
+func KeyFromEnv(name string) (key []byte, err error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, fmt.Errorf("environment variable %s not set", name)
+	}
+
+	os.Unsetenv(name)
+	return DecodeKey([]byte(value))
+}
+
+// KeyFromFD reads a raw key encoded by EncodeKey from a file descriptor (ie a pipe set up by the parent process)
+// until EOF, and closes it.
+func KeyFromFD(fd uintptr) (key []byte, err error) {
+	f := os.NewFile(fd, fmt.Sprint("fd ", fd))
+	if f == nil {
+		return nil, fmt.Errorf("invalid file descriptor %d", fd)
+	}
+
+	defer f.Close()
+
+	encoded, err := io.ReadAll(f)
+	if err != nil {
+		return
+	}
+
+	defer memzero(encoded)
+	return DecodeKey(encoded)
+}
+
+// AddRawKey adds a slot opened by a raw key (see ReadKeyFile, KeyFromEnv and KeyFromFD). The store must be unlocked.
+func (s *Store) AddRawKey(label string, key []byte) (err error) {
+	if err = s.checkNewSlot(label); err != nil {
+		return
+	}
+	if len(key) < minKeySize {
+		return ErrKeyTooShort
+	}
+
+	k, err := s.newRawKeySlot(key)
+	if err != nil {
+		return
+	}
+
+	s.addSlot(label, k)
+	return
+}
+
+// newRawKeySlot returns a raw key slot holding the master key.
+func (s *Store) newRawKeySlot(key []byte) (k keyEntry, err error) {
+	salt := make([]byte, 16)
+	if err = randRead(salt); err != nil {
+		return
+	}
+
+	kek := deriveSlotKey(key, salt, slotRawKey)
+	defer memzero(kek[:])
+
+	encKey, err := s.wrapKey(&kek)
+	if err != nil {
+		return
+	}
+
+	k = keyEntry{kind: slotRawKey, salt: salt, encKey: encKey}
+	return
+}
+
+// UnlockWithKey unlocks the store with a raw key. The key is zeroed.
+func (s *Store) UnlockWithKey(key []byte) (ok bool) {
+	defer memzero(key)
+
+	if len(key) < minKeySize {
+		return
+	}
+
+	for i, k := range s.keys {
+		if k.kind != slotRawKey {
+			continue
+		}
+
+		kek := deriveSlotKey(key, k.salt, slotRawKey)
+		ok = s.unwrapKey(k.encKey, &kek)
+		memzero(kek[:])
+
+		if ok {
+			return s.unlockSlot(i)
+		}
+	}
+	return false
+}
+
+// GenerateIdentity returns a new X25519 key pair: the identity unlocks the slots added for the recipient.
+func GenerateIdentity() (identity, recipient [32]byte, err error) {
+	if err = randRead(identity[:]); err != nil {
+		return
+	}
+
+	pub, err := curve25519.X25519(identity[:], curve25519.Basepoint)
+	if err != nil {
+		return
+	}
+
+	copy(recipient[:], pub)
+	return
+}
+
+// AddRecipient adds a slot opened by the identity of the X25519 recipient, like age's X25519 recipients (but the
+// store doesn't use age's file format). The store must be unlocked.
+func (s *Store) AddRecipient(label string, recipient [32]byte) (err error) {
+	if err = s.checkNewSlot(label); err != nil {
+		return
+	}
+
+	k, err := s.newRecipientSlot(slotX25519, &recipient)
+	if err != nil {
+		return
+	}
+
+	k.recipient = recipient[:]
+	s.addSlot(label, k)
+	return
+}
+
+// UnlockWithIdentity unlocks the store with the identity of a recipient.
+func (s *Store) UnlockWithIdentity(identity [32]byte) (ok bool) {
+	recipient, err := curve25519.X25519(identity[:], curve25519.Basepoint)
+	if err != nil {
+		return
+	}
+
+	return s.openRecipientSlots(slotX25519, recipient, &identity)
+}
+
+// AddSSHKey adds a slot opened by the private key of an ssh-ed25519 public key (ie parsed with
+// ssh.ParseAuthorizedKey). The store must be unlocked.
+func (s *Store) AddSSHKey(label string, pub ssh.PublicKey) (err error) {
+	if err = s.checkNewSlot(label); err != nil {
+		return
+	}
+
+	recipient, err := sshRecipient(pub)
+	if err != nil {
+		return
+	}
+
+	k, err := s.newRecipientSlot(slotSSH, &recipient)
+	if err != nil {
+		return
+	}
+
+	k.recipient = pub.Marshal()
+	s.addSlot(label, k)
+	return
+}
+
+// UnlockWithSSHKey unlocks the store with an ed25519 private key (ie parsed with ssh.ParseRawPrivateKey).
+func (s *Store) UnlockWithSSHKey(key ed25519.PrivateKey) (ok bool) {
+	if len(key) != ed25519.PrivateKeySize {
+		return
+	}
+
+	pub, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		return
+	}
+
+	// the X25519 private key of an ed25519 key is its clamped scalar (clamping is done by X25519)
+	h := sha512.Sum512(key.Seed())
+	defer memzero(h[:])
+
+	var identity [32]byte
+	copy(identity[:], h[:32])
+	defer memzero(identity[:])
+
+	return s.openRecipientSlots(slotSSH, pub.Marshal(), &identity)
+}
+
+// sshRecipient returns the X25519 recipient of an ssh-ed25519 public key.
+func sshRecipient(pub ssh.PublicKey) (recipient [32]byte, err error) {
+	cpk, ok := pub.(ssh.CryptoPublicKey)
+	if !ok || pub.Type() != ssh.KeyAlgoED25519 {
+		return recipient, ErrNotEd25519
+	}
+	edPub, ok := cpk.CryptoPublicKey().(ed25519.PublicKey)
+	if !ok {
+		return recipient, ErrNotEd25519
+	}
+
+	return ed25519ToX25519(edPub)
+}
+
+// checkNewSlot checks that a slot with the given label can be added.
+func (s *Store) checkNewSlot(label string) error {
+	if !s.unlocked {
+		return ErrLocked
+	}
+	if s.slotIndex(label) != -1 {
+		return ErrDuplicateLabel
+	}
+	return nil
+}
+
+func (s *Store) addSlot(label string, k keyEntry) {
+	k.label = label
+	k.created = time.Now()
+	s.keys = append(s.keys, k)
+}
+
+// newRecipientSlot returns a slot holding the master key, wrapped with a key agreed between an ephemeral key, stored
+// as the slot's salt, and the recipient.
+func (s *Store) newRecipientSlot(kind byte, recipient *[32]byte) (k keyEntry, err error) {
+	ephemeral := make([]byte, 32)
+	if err = randRead(ephemeral); err != nil {
+		return
+	}
+	defer memzero(ephemeral)
+
+	ephemeralPub, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
+	if err != nil {
+		return
+	}
+
+	shared, err := curve25519.X25519(ephemeral, recipient[:])
+	if err != nil {
+		return
+	}
+	defer memzero(shared)
+
+	kek := deriveSlotKey(shared, append(ephemeralPub, recipient[:]...), kind)
+	defer memzero(kek[:])
+
+	encKey, err := s.wrapKey(&kek)
+	if err != nil {
+		return
+	}
+
+	k = keyEntry{kind: kind, salt: ephemeralPub, encKey: encKey}
+	return
+}
+
+// openRecipientSlots opens the first slot of the given kind for the recipient, with its identity.
+func (s *Store) openRecipientSlots(kind byte, recipient []byte, identity *[32]byte) (ok bool) {
+	pub, err := curve25519.X25519(identity[:], curve25519.Basepoint)
+	if err != nil {
+		return
+	}
+
+	for i, k := range s.keys {
+		if k.kind != kind || !bytes.Equal(k.recipient, recipient) {
+			continue
+		}
+
+		shared, err := curve25519.X25519(identity[:], k.salt)
+		if err != nil {
+			continue
+		}
+
+		kek := deriveSlotKey(shared, append(bytes.Clone(k.salt), pub...), kind)
+		ok = s.unwrapKey(k.encKey, &kek)
+		memzero(kek[:])
+		memzero(shared)
+
+		if ok {
+			return s.unlockSlot(i)
+		}
+	}
+	return false
+}
+
+// unlockSlot finishes unlocking the store, once the master key was opened by the slot at idx.
+func (s *Store) unlockSlot(idx int) (ok bool) {
+	if err := s.unlockDataKey(); err != nil {
+		memzero(s.key[:])
+		return
+	}
+
+	s.keys[idx].lastUsed = time.Now()
+	s.unlocked = true
+	return true
+}
+
+// deriveSlotKey derives the key of a slot from high-entropy secrets (unlike passphrases, they don't need a KDF).
+func deriveSlotKey(secret, salt []byte, kind byte) (key [32]byte) {
+	r := hkdf.New(sha256.New, secret, salt, []byte("secretstore "+slotKinds[kind]))
+	if _, err := io.ReadFull(r, key[:]); err != nil {
+		panic(err) // can't fail for 32 bytes
+	}
+	return
+}
+
+var curve25519P, _ = new(big.Int).SetString("57896044618658097711785492504343953926634992332820282019728792003956564819949", 10)
+
+// ed25519ToX25519 converts an ed25519 public key to its X25519 form (u = (1+y)/(1-y)), as age does for SSH keys.
+func ed25519ToX25519(pub ed25519.PublicKey) (x [32]byte, err error) {
+	if len(pub) != ed25519.PublicKeySize {
+		return x, ErrNotEd25519
+	}
+
+	// y is little endian, without the sign bit of x
+	be := make([]byte, 32)
+	for i, b := range pub {
+		be[31-i] = b
+	}
+	be[0] &= 0x7f
+
+	p := curve25519P
+	y := new(big.Int).SetBytes(be)
+	if y.Cmp(p) >= 0 {
+		return x, ErrNotEd25519
+	}
+
+	one := big.NewInt(1)
+	den := new(big.Int).Sub(one, y)
+	den.Mod(den, p)
+	if den.Sign() == 0 {
+		return x, ErrNotEd25519
+	}
+
+	u := new(big.Int).Add(one, y)
+	u.Mul(u, den.ModInverse(den, p))
+	u.Mod(u, p)
+
+	u.FillBytes(be)
+	for i, b := range be {
+		x[31-i] = b
+	}
+	return
+}
+
+// recipientString returns the recipient of a slot, as shown by Keys.
+func (k *keyEntry) recipientString() string {
+	switch k.kind {
+	case slotX25519:
+		return hex.EncodeToString(k.recipient)
+	case slotSSH:
+		pub, err := ssh.ParsePublicKey(k.recipient)
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))
+	}
+	return ""
+}
+
+// usesKDF tells if the slot is opened by a passphrase.
+func (k *keyEntry) usesKDF() bool {
+	return k.kind == slotLegacy || k.kind == slotPassphrase
+}
+
+// hasSecret tells if the slot is opened by a secret (passphrase or raw key), as opposed to a recipient slot.
+func (k *keyEntry) hasSecret() bool {
+	return k.usesKDF() || k.kind == slotRawKey
+}
@@ -0,0 +1,138 @@
+package secretstore
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// binaryKey returns a raw key ending with line breaks, which must be kept.
+func binaryKey(t *testing.T) []byte {
+	t.Helper()
+
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(key[:len(key)-2], '\r', '\n')
+}
+
+func TestKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	key := binaryKey(t)
+
+	path := filepath.Join(dir, "key")
+	if err := WriteKeyFile(path, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteKeyFile(path, key); !os.IsExist(err) {
+		t.Errorf("expected the existing file to be kept, got %v", err)
+	}
+
+	if read, err := ReadKeyFile(path); err != nil || !bytes.Equal(read, key) {
+		t.Errorf("got %x, %v, expected %x", read, err, key)
+	}
+
+	generated, err := GenerateKeyFile(filepath.Join(dir, "generated"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat, err := os.Stat(filepath.Join(dir, "generated")); err != nil || stat.Mode().Perm() != 0600 {
+		t.Errorf("unexpected file mode: %v, %v", stat.Mode(), err)
+	}
+	if read, err := ReadKeyFile(filepath.Join(dir, "generated")); err != nil || !bytes.Equal(read, generated) {
+		t.Errorf("got %x, %v, expected %x", read, err, generated)
+	}
+
+	os.WriteFile(filepath.Join(dir, "invalid"), []byte("not base64!\n"), 0600)
+	if _, err := ReadKeyFile(filepath.Join(dir, "invalid")); err == nil {
+		t.Error("expected an error on an invalid key file")
+	}
+}
+
+func TestKeyFromEnv(t *testing.T) {
+	key := binaryKey(t)
+
+	const name = "SECRETSTORE_TEST_KEY"
+	t.Setenv(name, EncodeKey(key)+"\n")
+
+	if read, err := KeyFromEnv(name); err != nil || !bytes.Equal(read, key) {
+		t.Errorf("got %x, %v, expected %x", read, err, key)
+	}
+	if _, ok := os.LookupEnv(name); ok {
+		t.Error("variable not unset")
+	}
+	if _, err := KeyFromEnv(name); err == nil {
+		t.Error("expected an error on an unset variable")
+	}
+}
+
+func TestKeyFromFD(t *testing.T) {
+	key := binaryKey(t)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		w.WriteString(EncodeKey(key) + "\n")
+		w.Close()
+	}()
+
+	if read, err := KeyFromFD(r.Fd()); err != nil || !bytes.Equal(read, key) {
+		t.Errorf("got %x, %v, expected %x", read, err, key)
+	}
+}
+
+func TestRawKey(t *testing.T) {
+	s := newTestStore(t)
+	key := binaryKey(t)
+
+	if err := s.AddRawKey("ci", key[:minKeySize-1]); err != ErrKeyTooShort {
+		t.Errorf("expected ErrKeyTooShort, got %v", err)
+	}
+	if err := s.AddRawKey("ci", key); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "key")
+	if err := WriteKeyFile(path, key); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadKeyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s2, err := readStore(writeStore(t, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+
+	if s2.UnlockWithKey(bytes.Clone(read[:len(read)-1])) {
+		t.Error("unlocked with a truncated key")
+	}
+	if s2.UnlockWithKey(bytes.Clone(read[:minKeySize-1])) {
+		t.Error("unlocked with a too short key")
+	}
+	if !s2.UnlockWithKey(read) {
+		t.Error("failed to unlock with the key read back")
+	}
+	if !bytes.Equal(read, make([]byte, len(key))) {
+		t.Error("key not zeroed")
+	}
+}
+
+func TestSSHKeyLength(t *testing.T) {
+	s := newTestStore(t)
+
+	for _, key := range []ed25519.PrivateKey{nil, make(ed25519.PrivateKey, ed25519.SeedSize)} {
+		if s.UnlockWithSSHKey(key) {
+			t.Errorf("unlocked with a %d bytes key", len(key))
+		}
+	}
+}
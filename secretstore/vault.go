@@ -0,0 +1,204 @@
+package secretstore
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+var ErrNoSuchSecret = errors.New("no such secret")
+
+// SecretInfo describes a secret of the vault.
+type SecretInfo struct {
+	Name    string
+	Created time.Time
+	Updated time.Time
+	// Version is the current version; older ones are in Versions
+	Version  int
+	Versions []SecretVersion
+}
+
+type SecretVersion struct {
+	Version int
+	Created time.Time
+}
+
+type secretEntry struct {
+	Name     string          `json:"name"`
+	Created  time.Time       `json:"created"`
+	Updated  time.Time       `json:"updated"`
+	Versions []sealedVersion `json:"versions"`
+}
+
+type sealedVersion struct {
+	Version int       `json:"v"`
+	Created time.Time `json:"created"`
+	Data    []byte    `json:"data"`
+}
+
+func (e *secretEntry) current() *sealedVersion {
+	return &e.Versions[len(e.Versions)-1]
+}
+
+// PutSecret stores a new version of the secret, encrypted with the data key. The store must be unlocked, and saved
+// to persist the secret.
+func (s *Store) PutSecret(name string, value []byte) (version int, err error) {
+	if !s.unlocked {
+		return 0, ErrLocked
+	}
+	if name == "" {
+		return 0, errors.New("secret name is empty")
+	}
+
+	now := time.Now()
+
+	e := s.secrets[name]
+	if e == nil {
+		e = &secretEntry{Name: name, Created: now}
+	}
+
+	version = 1
+	if len(e.Versions) != 0 {
+		version = e.current().Version + 1
+	}
+
+	data, err := s.seal(&s.dataKey, value, secretContext(name, version))
+	if err != nil {
+		return
+	}
+
+	e.Versions = append(e.Versions, sealedVersion{Version: version, Created: now, Data: data})
+	e.Updated = now
+
+	if s.secrets == nil {
+		s.secrets = map[string]*secretEntry{}
+	}
+	s.secrets[name] = e
+	return
+}
+
+// GetSecret returns the current value of the secret.
+func (s *Store) GetSecret(name string) (value []byte, err error) {
+	return s.GetSecretVersion(name, 0)
+}
+
+// GetSecretVersion returns the given version of the secret (the current one if version is 0).
+func (s *Store) GetSecretVersion(name string, version int) (value []byte, err error) {
+	if !s.unlocked {
+		return nil, ErrLocked
+	}
+
+	e := s.secrets[name]
+	if e == nil {
+		return nil, ErrNoSuchSecret
+	}
+
+	v := e.current()
+	if version != 0 {
+		v = nil
+		for i := range e.Versions {
+			if e.Versions[i].Version == version {
+				v = &e.Versions[i]
+				break
+			}
+		}
+		if v == nil {
+			return nil, fmt.Errorf("%w: version %d", ErrNoSuchSecret, version)
+		}
+	}
+
+	return s.open(&s.dataKey, v.Data, secretContext(name, v.Version))
+}
+
+// ListSecrets returns the secrets of the vault, by name. It doesn't need the store to be unlocked.
+func (s *Store) ListSecrets() (secrets []SecretInfo) {
+	secrets = make([]SecretInfo, 0, len(s.secrets))
+
+	for _, name := range s.secretNames() {
+		e := s.secrets[name]
+
+		info := SecretInfo{
+			Name:     e.Name,
+			Created:  e.Created,
+			Updated:  e.Updated,
+			Version:  e.current().Version,
+			Versions: make([]SecretVersion, 0, len(e.Versions)),
+		}
+		for _, v := range e.Versions {
+			info.Versions = append(info.Versions, SecretVersion{Version: v.Version, Created: v.Created})
+		}
+
+		secrets = append(secrets, info)
+	}
+	return
+}
+
+// DeleteSecret deletes the secret with all its versions.
+func (s *Store) DeleteSecret(name string) (err error) {
+	if s.secrets[name] == nil {
+		return ErrNoSuchSecret
+	}
+
+	delete(s.secrets, name)
+	return
+}
+
+// PruneSecret deletes the oldest versions of the secret, keeping the given number of versions (at least 1).
+func (s *Store) PruneSecret(name string, keep int) (err error) {
+	e := s.secrets[name]
+	if e == nil {
+		return ErrNoSuchSecret
+	}
+
+	if keep < 1 {
+		keep = 1
+	}
+	if len(e.Versions) > keep {
+		e.Versions = append([]sealedVersion(nil), e.Versions[len(e.Versions)-keep:]...)
+	}
+	return
+}
+
+func (s *Store) secretNames() (names []string) {
+	names = make([]string, 0, len(s.secrets))
+	for name := range s.secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// resealSecrets encrypts the secrets with the current data key, after a rotation from prev.
+func (s *Store) resealSecrets(prev *Store) (secrets map[string]*secretEntry, err error) {
+	secrets = make(map[string]*secretEntry, len(s.secrets))
+
+	for name, e := range s.secrets {
+		resealed := *e
+		resealed.Versions = make([]sealedVersion, len(e.Versions))
+
+		for i, v := range e.Versions {
+			var value []byte
+			value, err = prev.open(&prev.dataKey, v.Data, secretContext(name, v.Version))
+			if err != nil {
+				err = fmt.Errorf("secret %q version %d: %w", name, v.Version, err)
+				return
+			}
+
+			v.Data, err = s.seal(&s.dataKey, value, secretContext(name, v.Version))
+			memzero(value)
+			if err != nil {
+				return
+			}
+
+			resealed.Versions[i] = v
+		}
+
+		secrets[name] = &resealed
+	}
+	return
+}
+
+func secretContext(name string, version int) string {
+	return fmt.Sprintf("secret\x00%s\x00%d", name, version)
+}
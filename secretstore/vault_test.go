@@ -0,0 +1,191 @@
+package secretstore
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestVault(t *testing.T) {
+	s := newTestStore(t)
+
+	if _, err := s.PutSecret("", []byte("x")); err == nil {
+		t.Error("expected an empty name to be rejected")
+	}
+
+	for i, value := range []string{"v1", "v2", "v3"} {
+		if version, err := s.PutSecret("db", []byte(value)); err != nil || version != i+1 {
+			t.Fatalf("put %s: got version %d, %v", value, version, err)
+		}
+	}
+	if _, err := s.PutSecret("api", []byte("key")); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := s.GetSecret("db"); err != nil || string(v) != "v3" {
+		t.Errorf("current: got %q, %v", v, err)
+	}
+	if v, err := s.GetSecretVersion("db", 1); err != nil || string(v) != "v1" {
+		t.Errorf("version 1: got %q, %v", v, err)
+	}
+	if _, err := s.GetSecretVersion("db", 4); !errors.Is(err, ErrNoSuchSecret) {
+		t.Errorf("version 4: expected ErrNoSuchSecret, got %v", err)
+	}
+	if _, err := s.GetSecret("nope"); err != ErrNoSuchSecret {
+		t.Errorf("expected ErrNoSuchSecret, got %v", err)
+	}
+
+	list := s.ListSecrets()
+	if len(list) != 2 || list[0].Name != "api" || list[1].Name != "db" || list[1].Version != 3 ||
+		len(list[1].Versions) != 3 || list[1].Versions[0].Version != 1 || list[1].Created.IsZero() ||
+		list[1].Updated.Before(list[1].Created) {
+		t.Errorf("unexpected list: %+v", list)
+	}
+
+	if err := s.PruneSecret("db", 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetSecretVersion("db", 1); !errors.Is(err, ErrNoSuchSecret) {
+		t.Errorf("pruned version 1: expected ErrNoSuchSecret, got %v", err)
+	}
+	if v, err := s.GetSecretVersion("db", 2); err != nil || string(v) != "v2" {
+		t.Errorf("version 2: got %q, %v", v, err)
+	}
+
+	// the current version is always kept
+	if err := s.PruneSecret("db", 0); err != nil {
+		t.Fatal(err)
+	}
+	if info := s.ListSecrets()[1]; len(info.Versions) != 1 || info.Version != 3 {
+		t.Errorf("unexpected versions after pruning: %+v", info)
+	}
+	if err := s.PruneSecret("nope", 1); err != ErrNoSuchSecret {
+		t.Errorf("expected ErrNoSuchSecret, got %v", err)
+	}
+
+	// versions keep increasing
+	if version, err := s.PutSecret("db", []byte("v4")); err != nil || version != 4 {
+		t.Errorf("put v4: got version %d, %v", version, err)
+	}
+
+	if err := s.DeleteSecret("db"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetSecret("db"); err != ErrNoSuchSecret {
+		t.Errorf("expected ErrNoSuchSecret, got %v", err)
+	}
+	if err := s.DeleteSecret("db"); err != ErrNoSuchSecret {
+		t.Errorf("expected ErrNoSuchSecret, got %v", err)
+	}
+
+	// a deleted secret starts again at version 1
+	if version, err := s.PutSecret("db", []byte("again")); err != nil || version != 1 {
+		t.Errorf("put again: got version %d, %v", version, err)
+	}
+}
+
+func TestVaultBinding(t *testing.T) {
+	s := newTestStore(t)
+
+	s.PutSecret("a", []byte("A"))
+	s.PutSecret("b", []byte("B"))
+	s.PutSecret("b", []byte("B2"))
+
+	// sealed values can't be moved to another secret or version
+	s.secrets["a"].Versions[0].Data, s.secrets["b"].Versions[0].Data = s.secrets["b"].Versions[0].Data, s.secrets["a"].Versions[0].Data
+	if _, err := s.GetSecret("a"); err != ErrAuthFailed {
+		t.Errorf("swapped secrets: expected ErrAuthFailed, got %v", err)
+	}
+
+	b := s.secrets["b"]
+	b.Versions[0].Data, b.Versions[1].Data = b.Versions[1].Data, b.Versions[0].Data
+	if _, err := s.GetSecret("b"); err != ErrAuthFailed {
+		t.Errorf("swapped versions: expected ErrAuthFailed, got %v", err)
+	}
+}
+
+func TestVaultPersistence(t *testing.T) {
+	s := newTestStore(t)
+
+	s.PutSecret("db", []byte("v1"))
+	s.PutSecret("db", []byte("v2"))
+	s.PutSecret("api", []byte("key"))
+
+	s2, err := readStore(writeStore(t, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+
+	// listing doesn't need the store to be unlocked
+	if list := s2.ListSecrets(); len(list) != 2 || list[1].Name != "db" || list[1].Version != 2 {
+		t.Errorf("unexpected list: %+v", list)
+	}
+	if _, err := s2.GetSecret("db"); err != ErrLocked {
+		t.Errorf("expected ErrLocked, got %v", err)
+	}
+	if _, err := s2.PutSecret("db", []byte("v3")); err != ErrLocked {
+		t.Errorf("expected ErrLocked, got %v", err)
+	}
+
+	if !s2.Unlock([]byte("test")) {
+		t.Fatal("failed to unlock")
+	}
+
+	for _, tc := range []struct {
+		name    string
+		version int
+		value   string
+	}{{"db", 0, "v2"}, {"db", 1, "v1"}, {"api", 0, "key"}} {
+		if v, err := s2.GetSecretVersion(tc.name, tc.version); err != nil || string(v) != tc.value {
+			t.Errorf("%s version %d: got %q, %v", tc.name, tc.version, v, err)
+		}
+	}
+
+	// a store read from an older format has no vault yet
+	s2.secrets = nil
+	if _, err := s2.PutSecret("new", []byte("value")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVaultRotation(t *testing.T) {
+	s := newTestStore(t)
+
+	s.PutSecret("db", []byte("v1"))
+	s.PutSecret("db", []byte("v2"))
+
+	prevData := bytes.Clone(s.secrets["db"].Versions[0].Data)
+	prevDataKey := s.dataKey
+
+	if err := s.RotateMasterKey(map[string][]byte{"default": []byte("test")}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Equal(s.secrets["db"].Versions[0].Data, prevData) {
+		t.Error("secret not resealed")
+	}
+	for version, value := range map[int]string{1: "v1", 2: "v2"} {
+		if v, err := s.GetSecretVersion("db", version); err != nil || string(v) != value {
+			t.Errorf("version %d: got %q, %v", version, v, err)
+		}
+	}
+
+	if _, err := s.open(&prevDataKey, s.secrets["db"].Versions[0].Data, secretContext("db", 1)); err != ErrAuthFailed {
+		t.Errorf("previous data key: expected ErrAuthFailed, got %v", err)
+	}
+
+	// a secret that can't be opened fails the rotation, which is undone
+	s.secrets["db"].Versions[0].Data[20] ^= 1
+	file := writeStore(t, s)
+
+	if err := s.RotateMasterKey(map[string][]byte{"default": []byte("test")}, nil); !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("expected ErrAuthFailed, got %v", err)
+	}
+	if !bytes.Equal(writeStore(t, s), file) {
+		t.Error("store changed by a failed rotation")
+	}
+	if v, err := s.GetSecret("db"); err != nil || string(v) != "v2" {
+		t.Errorf("got %q, %v", v, err)
+	}
+}
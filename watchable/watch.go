@@ -2,13 +2,15 @@ package watchable
 
 import (
 	"context"
+	"sync"
 	"time"
 )
 
 type Watch[T any] struct {
-	w      *Watchable[T]
-	rev    uint64
-	stopCh chan struct{}
+	w        *Watchable[T]
+	rev      uint64
+	stopCh   chan struct{}
+	stopOnce sync.Once
 }
 
 func (w *Watchable[T]) NewWatch() *Watch[T] {
@@ -35,11 +37,7 @@ func (w *Watchable[T]) NewWatchWithContext(ctx context.Context) (watch *Watch[T]
 }
 
 func (w *Watch[T]) Stop() {
-	ch := w.stopCh
-	if ch != nil {
-		close(ch)
-		w.stopCh = nil
-	}
+	w.stopOnce.Do(func() { close(w.stopCh) })
 }
 
 func (w *Watch[T]) NextWithTimeout(timeout time.Duration) (next T, ok, timedOut bool) {
@@ -50,3 +50,37 @@ func TestWatch(t *testing.T) {
 		t.Error("exited before expiry")
 	}
 }
+
+func TestWatchStop(t *testing.T) {
+	wable := New[int]()
+	wable.Set(1)
+
+	w := wable.NewWatch()
+	if v, ok := w.Next(); !ok || v != 1 {
+		t.Fatalf("got %d, %v", v, ok)
+	}
+
+	done := make(chan bool)
+	go func() {
+		_, _, timedOut := w.NextWithTimeout(time.Minute)
+		done <- timedOut
+	}()
+
+	time.Sleep(time.Millisecond)
+	w.Stop()
+	w.Stop()
+
+	select {
+	case timedOut := <-done:
+		if !timedOut {
+			t.Error("expected the stopped wait to time out")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop didn't end the wait")
+	}
+
+	// a stopped watch doesn't wait anymore
+	if _, _, timedOut := w.NextWithTimeout(time.Minute); !timedOut {
+		t.Error("expected the stopped watch to time out")
+	}
+}
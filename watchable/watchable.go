@@ -37,11 +37,15 @@ func (w *Watchable[T]) NextWithTimeout(rev uint64, stopCh <-chan struct{}) (v T,
 	runCh := make(chan struct{}, 1)
 	defer close(runCh)
 
+	stopped := false
+
 	if stopCh != nil {
 		go func() {
 			select {
 			case <-stopCh:
-				timedOut = true
+				w.c.L.Lock()
+				stopped = true
+				w.c.L.Unlock()
 				w.c.Broadcast()
 
 			case <-runCh:
@@ -60,7 +64,8 @@ func (w *Watchable[T]) NextWithTimeout(rev uint64, stopCh <-chan struct{}) (v T,
 		if w.closed {
 			return
 		}
-		if timedOut {
+		if stopped {
+			timedOut = true
 			v = w.v // return the current value anyway
 			return
 		}